@@ -1,24 +1,75 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
 	"github.com/nehachuha1/wbtech-tasks/internal/server"
 	"github.com/nehachuha1/wbtech-tasks/pkg/log"
 	"html/template"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // Подгружаем переменные окружения, инициализиуем логгер, который будет дальше прокидываться
-// ко всем управляющим структурам, а также билдим сервер. Запускается на порту :8080
+// ко всем управляющим структурам, а также билдим сервер. По умолчанию запускается на порту :8080.
+// При получении SIGINT/SIGTERM выключаем готовность (/readyz) и через DrainDelay перестаём принимать запросы,
+// дожидаемся завершения текущих и останавливаем все компоненты сервиса, но не дольше ShutdownTimeout. SIGHUP переоткрывает файлы логов (см. log.NewLogger).
+// Запуск с аргументом migrate вместо сервера выполняет подкоманду управления миграциями (см. runMigrate)
 func main() {
 	if err := godotenv.Load("./cmd/wbtech/.env"); err != nil {
 		panic(fmt.Sprintf("can't load .env: %v", err))
 	}
-	logger := log.NewLogger("./logs/logs.log")
+	logger, closeLogger := log.NewLogger(config.NewLogConfig().Options())
+	defer closeLogger()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		code := runMigrate(os.Args[2:], logger)
+		closeLogger()
+		os.Exit(code)
+	}
+	serverConfig := config.NewServerConfig()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	templates := template.Must(template.ParseGlob("./templates/*"))
-	router := server.BuildNewServer(templates, logger)
-	addr := ":8080"
-	logger.Info("starting server...")
-	http.ListenAndServe(addr, router)
+	srv := server.BuildNewServer(templates, serverConfig, logger)
+	httpServer := &http.Server{
+		Addr:    serverConfig.Addr,
+		Handler: srv.Router,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Infow("starting server", "addr", serverConfig.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		logger.Info("received shutdown signal, stopping server...")
+	case err := <-serveErr:
+		logger.Warnw("server stopped with error", "error", err)
+	}
+	stop()
+	srv.Drain()
+	time.Sleep(serverConfig.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logger.Warnw("failed on stopping http server", "error", err)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warnw("failed on stopping server components", "error", err)
+		return
+	}
+	logger.Info("server stopped")
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database"
+	pgmigrate "github.com/nehachuha1/wbtech-tasks/internal/migrations/postgres"
+	"go.uber.org/zap"
+	"os"
+	"strconv"
+	"time"
+)
+
+const migrateUsage = "usage: wbtech migrate up | down [steps] | status"
+
+// Подкоманда для ручного управления схемой: wbtech migrate up - применить все новые миграции,
+// wbtech migrate down [steps] - откатить последние steps миграций (по умолчанию одну),
+// wbtech migrate status - показать, какие миграции применены
+func runMigrate(args []string, logger *zap.SugaredLogger) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	postgres := database.NewPostgresDB(config.NewPostgresConfig(), logger)
+	defer postgres.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := pgmigrate.MigrateUp(ctx, postgres.DatabaseConnection)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%v\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil || parsed < 1 {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				return 2
+			}
+			steps = parsed
+		}
+		reverted, err := pgmigrate.MigrateDown(ctx, postgres.DatabaseConnection, steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d_%v\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(reverted) == 0 {
+			fmt.Println("nothing to revert")
+		}
+	case "status":
+		statuses, err := pgmigrate.Status(ctx, postgres.DatabaseConnection)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%v\t%v\n", status.Version, status.Name, appliedAt)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
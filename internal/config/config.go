@@ -1,7 +1,11 @@
 package config
 
 import (
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"github.com/nehachuha1/wbtech-tasks/pkg/retry"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,25 +17,75 @@ type PostgresConfig struct {
 	PostgresAddress  string
 	PostgresPort     string
 	PostgresDatabase string
+	ConflictPolicy   string
+	QueryTimeout     time.Duration
 }
 
 // Конфиг для работы с кафкой
 type KafkaConfig struct {
-	KafkaURL string
-	Topic    string
+	KafkaURL               string
+	Topic                  string
+	DeadLetterTopic        string
+	GroupID                string
+	RetryInterval          time.Duration
+	ProducerAsync          bool
+	ProducerFlushFrequency time.Duration
+	ProducerFlushMessages  int
+	OutboxPath             string
+	OutboxFlushInterval    time.Duration
+	MessageTimeout         time.Duration
 }
 
 // Конфиг для хранилища кэша
 type CacheConfig struct {
-	ClearInterval time.Duration
-	CacheLimit    int64
-	mu            sync.RWMutex
+	ClearInterval    time.Duration
+	CacheLimit       int64
+	ByteLimit        int64
+	EvictionPolicy   string
+	EntryTTL         time.Duration
+	RefreshOverlap   time.Duration
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	mu               sync.RWMutex
+}
+
+// Конфиг HTTP-сервера. ShutdownTimeout - сколько ждём завершения запросов и остановки всех компонентов
+// при получении SIGINT/SIGTERM
+type ServerConfig struct {
+	Addr            string
+	ShutdownTimeout time.Duration
+	RequestTimeout  time.Duration
+	DrainDelay      time.Duration
+}
+
+// Конфиг для повторов при временных ошибках (недоступность Postgres или брокера, дедлоки и т.д.)
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+// Конфиг логгера
+type LogConfig struct {
+	Level          string
+	Encoding       string
+	OutputPaths    []string
+	MaxSizeMB      int
+	MaxAgeDays     int
+	MaxBackups     int
+	Compress       bool
+	RotateInterval time.Duration
 }
 
 // В инициализация конфигов подгружаются переменные окружения. Если невозможно найти переменные окружения,
 // в поля структур присваиваются "дефолтные" значения.
 
-// Инициализация нового конфига для Postgres
+// Инициализация нового конфига для Postgres. ConflictPolicy - что делать с заказом, order_uid которого уже есть
+// в базе, но содержимое отличается: "reject" - отклонить, "version" - записать новой версией,
+// сохранив предыдущую в таблице order_versions.
+// QueryTimeout - сколько ждём ответа Postgres на один запрос (0 - без ограничения)
 func NewPostgresConfig() *PostgresConfig {
 	return &PostgresConfig{
 		PostgresUser:     getFromEnv("POSTGRES_USER", "admin"),
@@ -39,23 +93,120 @@ func NewPostgresConfig() *PostgresConfig {
 		PostgresAddress:  getFromEnv("POSTGRES_ADDRESS", "localhost"),
 		PostgresPort:     getFromEnv("POSTGRES_PORT", "5432"),
 		PostgresDatabase: getFromEnv("POSTGRES_DATABASE", "maindb"),
+		ConflictPolicy:   getFromEnv("ORDER_CONFLICT_POLICY", "reject"),
+		QueryTimeout:     getDurationFromEnv("POSTGRES_QUERY_TIMEOUT", time.Second*5),
 	}
 }
 
-// Инициализация нового конфига для Kafka
+// Инициализация нового конфига для Kafka. DeadLetterTopic - топик, куда уходят сообщения, которые не удалось
+// записать в базу. GroupID - имя consumer group, в которую объединяются все экземпляры сервиса.
+// RetryInterval - пауза перед повторной обработкой сообщения и переподключением к группе.
+// ProducerAsync включает асинхронную отправку пачками по ProducerFlushMessages сообщений
+// или раз в ProducerFlushFrequency. OutboxPath - файл локального outbox для заказов, которые не удалось отправить
+// из-за недоступности кафки (пустой путь отключает outbox), раз в OutboxFlushInterval outbox отправляется в топик
+// (KAFKA_OUTBOX_FLUSH_INTERVAL должен быть больше нуля, иначе используется значение по умолчанию).
+// MessageTimeout - сколько длится одна попытка обработки сообщения из очереди вместе с повторами записи в базу
 func NewKafkaConfig() *KafkaConfig {
 	return &KafkaConfig{
-		KafkaURL: getFromEnv("KAFKA_URL", "127.0.0.1:9092"),
-		Topic:    getFromEnv("KAFKA_TOPIC", "orders"),
+		KafkaURL:               getFromEnv("KAFKA_URL", "127.0.0.1:9092"),
+		Topic:                  getFromEnv("KAFKA_TOPIC", "orders"),
+		DeadLetterTopic:        getFromEnv("KAFKA_DEAD_LETTER_TOPIC", "orders-dlq"),
+		GroupID:                getFromEnv("KAFKA_GROUP_ID", "orders-service"),
+		RetryInterval:          getDurationFromEnv("KAFKA_RETRY_INTERVAL", time.Second*5),
+		ProducerAsync:          getBoolFromEnv("KAFKA_PRODUCER_ASYNC", false),
+		ProducerFlushFrequency: getDurationFromEnv("KAFKA_PRODUCER_FLUSH_FREQUENCY", time.Millisecond*100),
+		ProducerFlushMessages:  getIntFromEnv("KAFKA_PRODUCER_FLUSH_MESSAGES", 100),
+		OutboxPath:             getFromEnv("KAFKA_OUTBOX_PATH", ""),
+		OutboxFlushInterval:    getPositiveDurationFromEnv("KAFKA_OUTBOX_FLUSH_INTERVAL", time.Second*10),
+		MessageTimeout:         getDurationFromEnv("KAFKA_MESSAGE_TIMEOUT", time.Minute),
 	}
 }
 
-// Инициализация нового конфига для хранилища кэша. Очищение хранилища происходит каждые 30 минут. Лимит по количеству
-// записей - 5000
+// Инициализация нового конфига для хранилища кэша. Обновление хранилища из Postgres происходит каждые 30 минут
+// (CACHE_REFRESH_INTERVAL должен быть больше нуля, иначе используется значение по умолчанию).
+// Лимит по количеству записей - 5000, по памяти - без ограничения. Политика вытеснения - lru, lfu или ttl
+// (для ttl нужен CACHE_ENTRY_TTL больше нуля). RefreshOverlap - на сколько назад от отметки последнего обновления
+// перечитываем заказы, чтобы не пропустить транзакции, которые закоммитились позже, чем записали updated_at.
+// SnapshotPath - файл снапшота кэша для быстрого старта (пустой путь - снапшоты выключены), пишется раз в 5 минут
+// и при остановке сервиса. Если CACHE_SNAPSHOT_INTERVAL не больше нуля, снапшот пишется только при остановке
 func NewCacheConfig() *CacheConfig {
 	return &CacheConfig{
-		ClearInterval: time.Minute * time.Duration(30),
-		CacheLimit:    5000,
+		ClearInterval:    getPositiveDurationFromEnv("CACHE_REFRESH_INTERVAL", time.Minute*time.Duration(30)),
+		CacheLimit:       int64(getIntFromEnv("CACHE_LIMIT", 5000)),
+		ByteLimit:        int64(getIntFromEnv("CACHE_BYTE_LIMIT", 0)),
+		EvictionPolicy:   getFromEnv("CACHE_EVICTION_POLICY", "lru"),
+		EntryTTL:         getDurationFromEnv("CACHE_ENTRY_TTL", 0),
+		RefreshOverlap:   getDurationFromEnv("CACHE_REFRESH_OVERLAP", time.Minute),
+		SnapshotPath:     getFromEnv("CACHE_SNAPSHOT_PATH", ""),
+		SnapshotInterval: getDurationFromEnv("CACHE_SNAPSHOT_INTERVAL", time.Minute*5),
+	}
+}
+
+// Инициализация нового конфига для HTTP-сервера. RequestTimeout - дедлайн обработки одного запроса: по его
+// истечении отменяются запросы в Postgres и ожидание брокера. DrainDelay - сколько после сигнала остановки
+// сервер продолжает принимать запросы с выключенной готовностью (/readyz отвечает 503), чтобы балансировщик успел
+// убрать его из ротации. В Kubernetes стоит задать больше периода readiness-пробы
+func NewServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Addr:            getFromEnv("SERVER_ADDR", ":8080"),
+		ShutdownTimeout: getDurationFromEnv("SHUTDOWN_TIMEOUT", time.Second*30),
+		RequestTimeout:  getDurationFromEnv("SERVER_REQUEST_TIMEOUT", time.Second*10),
+		DrainDelay:      getDurationFromEnv("SERVER_DRAIN_DELAY", 0),
+	}
+}
+
+// Инициализация нового конфига для повторов. По умолчанию 5 попыток с задержкой от 200мс до 10с, каждая следующая
+// задержка вдвое больше предыдущей, разброс - 20%
+func NewRetryConfig() *RetryConfig {
+	return &RetryConfig{
+		MaxAttempts:    getIntFromEnv("RETRY_MAX_ATTEMPTS", 5),
+		InitialBackoff: getDurationFromEnv("RETRY_INITIAL_BACKOFF", time.Millisecond*200),
+		MaxBackoff:     getDurationFromEnv("RETRY_MAX_BACKOFF", time.Second*10),
+		Multiplier:     getFloatFromEnv("RETRY_MULTIPLIER", 2),
+		Jitter:         getFloatFromEnv("RETRY_JITTER", 0.2),
+	}
+}
+
+// Инициализация нового конфига логгера. По умолчанию уровень info, записи в JSON пишутся в ./logs/logs.log
+// и stdout. LOG_OUTPUTS - список путей через запятую (файлы, stdout, stderr).
+// Файлы ротируются при достижении 100 МБ и раз в сутки, хранится 7 сжатых старых файлов не старше 14 дней.
+// Для внешнего logrotate собственную ротацию нужно выключить (LOG_MAX_SIZE_MB=0 и LOG_ROTATE_INTERVAL=0):
+// logrotate переименовывает файл и шлёт сервису SIGHUP, по которому файл открывается заново
+func NewLogConfig() *LogConfig {
+	return &LogConfig{
+		Level:          getFromEnv("LOG_LEVEL", "info"),
+		Encoding:       getFromEnv("LOG_ENCODING", "json"),
+		OutputPaths:    getListFromEnv("LOG_OUTPUTS", []string{"./logs/logs.log", "stdout"}),
+		MaxSizeMB:      getIntFromEnv("LOG_MAX_SIZE_MB", 100),
+		MaxAgeDays:     getIntFromEnv("LOG_MAX_AGE_DAYS", 14),
+		MaxBackups:     getIntFromEnv("LOG_MAX_BACKUPS", 7),
+		Compress:       getBoolFromEnv("LOG_COMPRESS", true),
+		RotateInterval: getDurationFromEnv("LOG_ROTATE_INTERVAL", time.Hour*24),
+	}
+}
+
+// Настройки логгера, построенные по конфигу
+func (cfg *LogConfig) Options() log.Options {
+	return log.Options{
+		Level:          cfg.Level,
+		Encoding:       cfg.Encoding,
+		OutputPaths:    cfg.OutputPaths,
+		MaxSizeMB:      cfg.MaxSizeMB,
+		MaxAgeDays:     cfg.MaxAgeDays,
+		MaxBackups:     cfg.MaxBackups,
+		Compress:       cfg.Compress,
+		RotateInterval: cfg.RotateInterval,
+	}
+}
+
+// Политика повторов, построенная по конфигу
+func (cfg *RetryConfig) Policy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+		Multiplier:     cfg.Multiplier,
+		Jitter:         cfg.Jitter,
 	}
 }
 
@@ -66,3 +217,70 @@ func getFromEnv(key string, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// Вспомогательная функция для получения списка значений через запятую из переменной окружения
+func getListFromEnv(key string, defaultValue []string) []string {
+	value, isExists := os.LookupEnv(key)
+	if !isExists {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return defaultValue
+	}
+	return list
+}
+
+// Вспомогательная функция для получения длительности из переменной окружения (в формате time.ParseDuration)
+func getDurationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	if value, isExists := os.LookupEnv(key); isExists {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
+// Вспомогательная функция для получения длительности, которая должна быть больше нуля (например, период тикера).
+// Нулевое или отрицательное значение заменяется значением по умолчанию
+func getPositiveDurationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	if duration := getDurationFromEnv(key, defaultValue); duration > 0 {
+		return duration
+	}
+	return defaultValue
+}
+
+// Вспомогательная функция для получения целого числа из переменной окружения
+func getIntFromEnv(key string, defaultValue int) int {
+	if value, isExists := os.LookupEnv(key); isExists {
+		if number, err := strconv.Atoi(value); err == nil {
+			return number
+		}
+	}
+	return defaultValue
+}
+
+// Вспомогательная функция для получения дробного числа из переменной окружения
+func getFloatFromEnv(key string, defaultValue float64) float64 {
+	if value, isExists := os.LookupEnv(key); isExists {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	}
+	return defaultValue
+}
+
+// Вспомогательная функция для получения булева значения из переменной окружения
+func getBoolFromEnv(key string, defaultValue bool) bool {
+	if value, isExists := os.LookupEnv(key); isExists {
+		if flag, err := strconv.ParseBool(value); err == nil {
+			return flag
+		}
+	}
+	return defaultValue
+}
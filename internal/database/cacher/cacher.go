@@ -1,135 +1,234 @@
 package cacher
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	ch "github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
 	"go.uber.org/zap"
 	"sync"
 	"time"
 )
 
-// Управляющая структура для работы с хранилищем кэша
+// Управляющая структура для работы с хранилищем кэша. CacheLimit - максимальное число записей, ByteLimit - бюджет
+// по памяти (размер order_uid + JSON заказа), 0 - без ограничения. При превышении любого из лимитов записи
+// по одной вытесняются согласно Policy. EntryTTL - срок жизни записи, 0 - записи не устаревают
 type CacheVault struct {
-	Data          map[string][]byte
-	mu            sync.RWMutex
+	Data          map[string]*CacheEntry
+	Policy        EvictionPolicy
+	mu            sync.Mutex
 	ClearInterval time.Duration
 	CacheLimit    int64
+	ByteLimit     int64
+	EntryTTL      time.Duration
+	usedBytes     int64
 	Logger        *zap.SugaredLogger
 	Quit          chan bool
 }
 
-// Метод для получения данных по order_uid из кэша
-func (cache *CacheVault) GetDataFromTable(out chan interface{}, key string) {
-	defer close(out)
+// Получение заказа по order_uid из кэша. Устаревшая запись удаляется и считается промахом (ErrNotFound)
+func (cache *CacheVault) Get(ctx context.Context, orderUid string) (*ch.Order, error) {
+	data, isExists := cache.lookup(orderUid)
+	if !isExists {
+		metrics.CacheMisses.Inc()
+		return nil, fmt.Errorf("order with order_uid %v in cache: %w", orderUid, ch.ErrNotFound)
+	}
+	metrics.CacheHits.Inc()
+	order := &ch.Order{}
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, fmt.Errorf("failed on unmarshaling cached order %v: %w", orderUid, err)
+	}
+	return order, nil
+}
 
-	queryResult := &ch.CacheQueryResult{
-		IsSuccessQuery: false,
-		Message:        "empty",
-		Data:           nil,
+// Получение нескольких заказов из кэша, отсутствующие в кэше пропускаются
+func (cache *CacheVault) GetMany(ctx context.Context, orderUids []string) ([]*ch.Order, error) {
+	fetchedOrders := make([]*ch.Order, 0, len(orderUids))
+	for _, orderUid := range orderUids {
+		order, err := cache.Get(ctx, orderUid)
+		if errors.Is(err, ch.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fetchedOrders = append(fetchedOrders, order)
 	}
+	return fetchedOrders, nil
+}
 
-	cache.mu.RLock()
-	order, isExists := cache.Data[key]
-	defer cache.mu.RUnlock()
+// Добавление заказа в кэш, где ключом будет order_uid. Существующая запись перезаписывается
+func (cache *CacheVault) Create(ctx context.Context, order *ch.Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("marshaling to JSON order error: %w", err)
+	}
 
-	if !isExists {
-		queryResult.Message = fmt.Sprintf("there's no current order_id %v in database", key)
-	} else {
-		queryResult.Message = fmt.Sprintf("found order with order_id %v", key)
-		queryResult.Data = order
-		queryResult.IsSuccessQuery = true
+	isSaved, isRewritten := cache.setEntry(order.OrderUid, data)
+	switch {
+	case !isSaved:
+		log.FromContext(ctx, cache.Logger).Warnw("order exceeds cache byte limit, not cached",
+			"order_uid", order.OrderUid, "bytes", len(data))
+		return fmt.Errorf("order with order_id %v exceeds cache byte limit", order.OrderUid)
+	case isRewritten:
+		log.FromContext(ctx, cache.Logger).Infow("rewrote order in cache", "order_uid", order.OrderUid)
+	default:
+		log.FromContext(ctx, cache.Logger).Infow("saved order in cache", "order_uid", order.OrderUid)
 	}
-	out <- queryResult
+	return nil
 }
 
-// Метод для добавления в кэш новых данных, где ключом будет order_uid
-func (cache *CacheVault) SetDataToTable(out chan interface{}, data []byte) {
-	defer close(out)
+// Кэш не умеет фильтровать и сортировать заказы, к тому же в нём лежат не все заказы
+func (cache *CacheVault) List(ctx context.Context, filter *ch.OrdersFilter) (*ch.OrdersPage, error) {
+	return nil, fmt.Errorf("listing orders from cache: %w", errors.ErrUnsupported)
+}
 
-	queryResult := &ch.CacheQueryResult{
-		Data:           nil,
-		Message:        "empty",
-		IsSuccessQuery: false,
+// Метод для пакетной записи заказов. Все записи применяются под одной блокировкой, поэтому читатели видят
+// кэш либо целиком до обновления, либо целиком после. Возвращает число сохранённых записей
+func (cache *CacheVault) SwapEntries(orders []*ch.Order) int {
+	entries := make(map[string][]byte, len(orders))
+	for _, order := range orders {
+		data, err := json.Marshal(order)
+		if err != nil {
+			continue
+		}
+		entries[order.OrderUid] = data
 	}
 
-	order := &ch.Order{}
-	err := json.Unmarshal(data, order)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 
-	if err != nil {
-		cache.Logger.Warn(fmt.Sprintf("marshaling to JSON order error: %v", err))
-		queryResult.Message = fmt.Sprintf("marshaling to JSON order error: %v", err)
-		out <- queryResult
+	saved := 0
+	for key, data := range entries {
+		if isSaved, _ := cache.setEntryLocked(key, data); isSaved {
+			saved++
+		}
 	}
+	return saved
+}
 
-	cache.mu.RLock()
-	if _, isExists := cache.Data[order.OrderUid]; !isExists {
-		cache.mu.RUnlock()
-
-		cache.mu.Lock()
-		cache.Data[order.OrderUid] = data
-		cache.mu.Unlock()
-		cache.Logger.Info(
-			fmt.Sprintf("saved order with order_id %v in cache", order.OrderUid))
-		queryResult.IsSuccessQuery = true
-		queryResult.Message = fmt.Sprintf("saved order with order_id %v in cache")
-		queryResult.Data = data
-		out <- queryResult
+// Метод для очистки кэша
+func (cache *CacheVault) ClearCache() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 
-	} else {
-		cache.mu.RUnlock()
-
-		cache.mu.Lock()
-		cache.Data[order.OrderUid] = data
-		cache.mu.Unlock()
-
-		cache.Logger.Info(
-			fmt.Sprintf("rewrite cache for order with order_id %v", order.OrderUid))
-		queryResult.IsSuccessQuery = true
-		queryResult.Message = fmt.Sprintf("resaved order with order_id %v in cache")
-		queryResult.Data = data
-		out <- queryResult
-	}
+	cache.Data = make(map[string]*CacheEntry)
+	cache.Policy.Reset()
+	cache.usedBytes = 0
+	cache.updateSizeMetrics()
+	cache.Logger.Info("cleared cache in CacheVault")
 }
 
-// Метод для подгрузки в кэш всех заказов. Используется при инициализации новой управляющей структуры для работы
-// с данными
-func (cache *CacheVault) LoadOrdersToCache(data []byte) {
-	var allOrders []ch.Order
-	err := json.Unmarshal(data, &allOrders)
-	if err != nil {
-		cache.Logger.Warn(fmt.Sprintf("failed on unmarshaling bytes to slice of orders: %v", err))
+// Поиск записи по ключу. Устаревшая запись удаляется и считается промахом
+func (cache *CacheVault) lookup(key string) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, isExists := cache.Data[key]
+	if !isExists {
+		return nil, false
 	}
-	for _, order := range allOrders {
-		out := make(chan interface{})
-		marshaledOrder, _ := json.Marshal(order)
-		go cache.SetDataToTable(out, marshaledOrder)
+	if entry.isExpired(time.Now()) {
+		cache.removeEntry(entry)
+		return nil, false
 	}
-	cache.Logger.Info("successfully loaded orders to cache")
+	cache.Policy.Accessed(entry)
+	return entry.Value, true
 }
 
-// Метод для очистки кэша
-func (cache *CacheVault) ClearCache() interface{} {
-	orderIDs := make([]string, 0)
+// Метод для удаления устаревших записей. Запускается периодически, чтобы записи, которые больше не читают,
+// не занимали место до следующего вытеснения
+func (cache *CacheVault) RemoveExpired() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 
-	cache.mu.RLock()
-	for key, _ := range cache.Data {
-		orderIDs = append(orderIDs, key)
+	now := time.Now()
+	removed := 0
+	for _, entry := range cache.Data {
+		if entry.isExpired(now) {
+			cache.removeEntry(entry)
+			removed++
+		}
 	}
-	cache.mu.RUnlock()
+	return removed
+}
 
+// Сохранение записи и вытеснение лишних. Возвращает false, если запись не поместится в кэш даже пустой,
+// и признак того, что запись с таким ключом уже была
+func (cache *CacheVault) setEntry(key string, data []byte) (bool, bool) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
-	for _, key := range orderIDs {
-		if _, isExists := cache.Data[key]; isExists {
-			delete(cache.Data, key)
+	return cache.setEntryLocked(key, data)
+}
+
+func (cache *CacheVault) setEntryLocked(key string, data []byte) (bool, bool) {
+	entry, isExists := cache.Data[key]
+	if isExists {
+		cache.usedBytes -= entry.size()
+		entry.Value = data
+		entry.ExpiresAt = cache.expiresAt()
+		cache.usedBytes += entry.size()
+		cache.Policy.Accessed(entry)
+	} else {
+		entry = &CacheEntry{Key: key, Value: data, ExpiresAt: cache.expiresAt()}
+		if cache.ByteLimit > 0 && entry.size() > cache.ByteLimit {
+			return false, false
 		}
+		cache.Data[key] = entry
+		cache.usedBytes += entry.size()
+		cache.Policy.Added(entry)
 	}
-	queryResult := &ch.CacheQueryResult{
-		Data:           nil,
-		Message:        "successfully cleared cache",
-		IsSuccessQuery: true,
+
+	if cache.ByteLimit > 0 && entry.size() > cache.ByteLimit {
+		cache.removeEntry(entry)
+		return false, isExists
 	}
-	cache.Logger.Info("cleared cache in CacheVault")
-	return queryResult
+	cache.evict(entry)
+	cache.updateSizeMetrics()
+	return true, isExists
+}
+
+// Вытеснение записей по одной, пока кэш не уложится в лимиты. Только что записанную запись не трогаем
+func (cache *CacheVault) evict(keep *CacheEntry) {
+	evicted := 0
+	for cache.isOverLimit() {
+		victim := cache.Policy.Victim(keep)
+		if victim == nil {
+			break
+		}
+		cache.removeEntry(victim)
+		evicted++
+	}
+	if evicted > 0 {
+		metrics.CacheEvictions.Add(float64(evicted))
+		cache.Logger.Infow("evicted orders from cache", "evicted", evicted)
+	}
+}
+
+func (cache *CacheVault) isOverLimit() bool {
+	return (cache.CacheLimit > 0 && int64(len(cache.Data)) > cache.CacheLimit) ||
+		(cache.ByteLimit > 0 && cache.usedBytes > cache.ByteLimit)
+}
+
+func (cache *CacheVault) removeEntry(entry *CacheEntry) {
+	cache.Policy.Removed(entry)
+	delete(cache.Data, entry.Key)
+	cache.usedBytes -= entry.size()
+	cache.updateSizeMetrics()
+}
+
+// Обновление метрик размера кэша, вызывается под блокировкой после каждого изменения
+func (cache *CacheVault) updateSizeMetrics() {
+	metrics.CacheEntries.Set(float64(len(cache.Data)))
+	metrics.CacheBytes.Set(float64(cache.usedBytes))
+}
+
+func (cache *CacheVault) expiresAt() time.Time {
+	if cache.EntryTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(cache.EntryTTL)
 }
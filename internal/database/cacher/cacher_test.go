@@ -0,0 +1,118 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCacheVault(t *testing.T, policyName string, cacheLimit int64, byteLimit int64) *CacheVault {
+	t.Helper()
+	return &CacheVault{
+		Data:       make(map[string]*CacheEntry),
+		Policy:     newTestPolicy(t, policyName),
+		CacheLimit: cacheLimit,
+		ByteLimit:  byteLimit,
+		EntryTTL:   time.Hour,
+		Logger:     zap.NewNop().Sugar(),
+	}
+}
+
+func assertCachedKeys(t *testing.T, cache *CacheVault, expected ...string) {
+	t.Helper()
+	if len(cache.Data) != len(expected) {
+		t.Fatalf("expected %v entries in cache, got %v", len(expected), len(cache.Data))
+	}
+	for _, key := range expected {
+		if _, isExists := cache.Data[key]; !isExists {
+			t.Fatalf("expected %v in cache", key)
+		}
+	}
+}
+
+func TestCacheVaultEvictsByEntriesLimit(t *testing.T) {
+	cache := newTestCacheVault(t, PolicyLRU, 2, 0)
+	cache.setEntry("first", []byte("1"))
+	cache.setEntry("second", []byte("2"))
+	cache.lookup("first")
+	cache.setEntry("third", []byte("3"))
+
+	assertCachedKeys(t, cache, "first", "third")
+}
+
+func TestCacheVaultEvictsByByteBudget(t *testing.T) {
+	// Размер записи - длина ключа и значения: каждая запись ниже занимает 10 байт
+	cache := newTestCacheVault(t, PolicyLRU, 0, 25)
+	cache.setEntry("first", []byte("11111"))
+	cache.setEntry("second", []byte("2222"))
+	if cache.usedBytes != 20 {
+		t.Fatalf("expected 20 used bytes, got %v", cache.usedBytes)
+	}
+
+	cache.setEntry("third", []byte("33333"))
+	assertCachedKeys(t, cache, "second", "third")
+	if cache.usedBytes != 20 {
+		t.Fatalf("expected 20 used bytes after eviction, got %v", cache.usedBytes)
+	}
+
+	// Перезапись большим значением вытесняет остальные записи, но не саму перезаписанную
+	if isSaved, isRewritten := cache.setEntry("third", []byte("333333333333333")); !isSaved || !isRewritten {
+		t.Fatalf("expected rewritten entry to be saved")
+	}
+	assertCachedKeys(t, cache, "third")
+	if cache.usedBytes != 20 {
+		t.Fatalf("expected 20 used bytes after rewrite, got %v", cache.usedBytes)
+	}
+
+	// Запись больше всего бюджета не сохраняется и не вытесняет остальные
+	if isSaved, _ := cache.setEntry("huge", []byte(strings.Repeat("x", 30))); isSaved {
+		t.Fatalf("expected entry over byte limit not to be saved")
+	}
+	assertCachedKeys(t, cache, "third")
+}
+
+func TestCacheVaultKeepsFrequencyOfRewrittenEntry(t *testing.T) {
+	cache := newTestCacheVault(t, PolicyLFU, 0, 25)
+	cache.setEntry("frequent", []byte("11111111"))
+	for idx := 0; idx < 3; idx++ {
+		cache.lookup("frequent")
+	}
+	cache.setEntry("rare", []byte("2222"))
+
+	// Перезаписанная запись - самая редкая, но её не вытесняют, и её история обращений сохраняется
+	cache.setEntry("rare", []byte("222222222222222"))
+	assertCachedKeys(t, cache, "rare")
+	if frequency := cache.Data["rare"].frequency; frequency != 2 {
+		t.Fatalf("expected frequency 2 of rewritten entry, got %v", frequency)
+	}
+}
+
+func TestCacheVaultExpiresEntries(t *testing.T) {
+	cache := newTestCacheVault(t, PolicyTTL, 0, 0)
+	cache.EntryTTL = time.Millisecond * 10
+	if err := cache.Create(context.Background(), &handlers.Order{OrderUid: "expiring"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := cache.Get(context.Background(), "expiring"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	if _, err := cache.Get(context.Background(), "expiring"); !errors.Is(err, handlers.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for expired entry, got %v", err)
+	}
+
+	cache.setEntry("first", []byte("1"))
+	cache.setEntry("second", []byte("2"))
+	time.Sleep(time.Millisecond * 20)
+	if removed := cache.RemoveExpired(); removed != 2 {
+		t.Fatalf("expected 2 removed entries, got %v", removed)
+	}
+	if cache.usedBytes != 0 {
+		t.Fatalf("expected empty cache, got %v used bytes", cache.usedBytes)
+	}
+}
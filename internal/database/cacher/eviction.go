@@ -0,0 +1,219 @@
+package cacher
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"time"
+)
+
+// Названия политик вытеснения записей из кэша
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+	PolicyTTL = "ttl"
+)
+
+// Запись хранилища кэша. Служебные поля используются политиками вытеснения
+type CacheEntry struct {
+	Key       string
+	Value     []byte
+	ExpiresAt time.Time
+
+	frequency  int64
+	lastAccess int64
+	element    *list.Element
+	index      int
+}
+
+// Размер записи в байтах, который учитывается в лимите по памяти
+func (e *CacheEntry) size() int64 {
+	return int64(len(e.Key) + len(e.Value))
+}
+
+// Проверка, что у записи истёк срок жизни
+func (e *CacheEntry) isExpired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// Политика вытеснения: хранилище сообщает ей о добавлении, чтении/перезаписи и удалении записей,
+// а при превышении лимитов спрашивает, какую запись вытеснить. Victim не меняет состояние политики и никогда
+// не возвращает exclude (только что записанную запись), nil - вытеснять нечего. Методы вызываются
+// под блокировкой хранилища
+type EvictionPolicy interface {
+	Added(entry *CacheEntry)
+	Accessed(entry *CacheEntry)
+	Removed(entry *CacheEntry)
+	Victim(exclude *CacheEntry) *CacheEntry
+	Reset()
+}
+
+// Инициализация политики вытеснения по названию
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case PolicyLRU:
+		return &lruPolicy{order: list.New()}, nil
+	case PolicyLFU:
+		return &lfuPolicy{}, nil
+	case PolicyTTL:
+		return &ttlPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache eviction policy %q", name)
+	}
+}
+
+// LRU - вытесняется запись, которую дольше всех не читали
+type lruPolicy struct {
+	order *list.List
+}
+
+func (p *lruPolicy) Added(entry *CacheEntry) {
+	entry.element = p.order.PushFront(entry)
+}
+
+func (p *lruPolicy) Accessed(entry *CacheEntry) {
+	p.order.MoveToFront(entry.element)
+}
+
+func (p *lruPolicy) Removed(entry *CacheEntry) {
+	p.order.Remove(entry.element)
+	entry.element = nil
+}
+
+func (p *lruPolicy) Victim(exclude *CacheEntry) *CacheEntry {
+	back := p.order.Back()
+	if back != nil && back.Value.(*CacheEntry) == exclude {
+		back = back.Prev()
+	}
+	if back == nil {
+		return nil
+	}
+	return back.Value.(*CacheEntry)
+}
+
+func (p *lruPolicy) Reset() {
+	p.order.Init()
+}
+
+// LFU - вытесняется запись, которую читали реже всех, при равенстве - та, которую дольше всех не читали
+type lfuPolicy struct {
+	entries entryHeap
+	clock   int64
+}
+
+func (p *lfuPolicy) Added(entry *CacheEntry) {
+	p.clock++
+	entry.frequency = 1
+	entry.lastAccess = p.clock
+	p.entries.less = lessByFrequency
+	heap.Push(&p.entries, entry)
+}
+
+func (p *lfuPolicy) Accessed(entry *CacheEntry) {
+	p.clock++
+	entry.frequency++
+	entry.lastAccess = p.clock
+	heap.Fix(&p.entries, entry.index)
+}
+
+func (p *lfuPolicy) Removed(entry *CacheEntry) {
+	heap.Remove(&p.entries, entry.index)
+}
+
+func (p *lfuPolicy) Victim(exclude *CacheEntry) *CacheEntry {
+	return p.entries.minExcluding(exclude)
+}
+
+func (p *lfuPolicy) Reset() {
+	p.entries.items = nil
+}
+
+// TTL - вытесняется запись, срок жизни которой истекает раньше всех
+type ttlPolicy struct {
+	entries entryHeap
+}
+
+func (p *ttlPolicy) Added(entry *CacheEntry) {
+	p.entries.less = lessByExpiration
+	heap.Push(&p.entries, entry)
+}
+
+func (p *ttlPolicy) Accessed(entry *CacheEntry) {
+	heap.Fix(&p.entries, entry.index)
+}
+
+func (p *ttlPolicy) Removed(entry *CacheEntry) {
+	heap.Remove(&p.entries, entry.index)
+}
+
+func (p *ttlPolicy) Victim(exclude *CacheEntry) *CacheEntry {
+	return p.entries.minExcluding(exclude)
+}
+
+func (p *ttlPolicy) Reset() {
+	p.entries.items = nil
+}
+
+func lessByFrequency(a *CacheEntry, b *CacheEntry) bool {
+	if a.frequency != b.frequency {
+		return a.frequency < b.frequency
+	}
+	return a.lastAccess < b.lastAccess
+}
+
+func lessByExpiration(a *CacheEntry, b *CacheEntry) bool {
+	return a.ExpiresAt.Before(b.ExpiresAt)
+}
+
+// Куча записей для LFU и TTL, реализует heap.Interface
+type entryHeap struct {
+	items []*CacheEntry
+	less  func(a *CacheEntry, b *CacheEntry) bool
+}
+
+// Наименьшая запись кучи, кроме exclude. Если exclude в корне, то следующая по порядку запись - один из двух
+// его потомков, так что куча не меняется
+func (h *entryHeap) minExcluding(exclude *CacheEntry) *CacheEntry {
+	if len(h.items) == 0 {
+		return nil
+	}
+	if h.items[0] != exclude {
+		return h.items[0]
+	}
+	var next *CacheEntry
+	for _, idx := range []int{1, 2} {
+		if idx < len(h.items) && (next == nil || h.less(h.items[idx], next)) {
+			next = h.items[idx]
+		}
+	}
+	return next
+}
+
+func (h *entryHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *entryHeap) Less(i, j int) bool {
+	return h.less(h.items[i], h.items[j])
+}
+
+func (h *entryHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *entryHeap) Push(x any) {
+	entry := x.(*CacheEntry)
+	entry.index = len(h.items)
+	h.items = append(h.items, entry)
+}
+
+func (h *entryHeap) Pop() any {
+	last := len(h.items) - 1
+	entry := h.items[last]
+	h.items[last] = nil
+	h.items = h.items[:last]
+	entry.index = -1
+	return entry
+}
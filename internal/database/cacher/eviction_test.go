@@ -0,0 +1,85 @@
+package cacher
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestPolicy(t *testing.T, name string) EvictionPolicy {
+	t.Helper()
+	policy, err := NewEvictionPolicy(name)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+	return policy
+}
+
+func TestLRUPolicyEvictsLeastRecentlyUsed(t *testing.T) {
+	policy := newTestPolicy(t, PolicyLRU)
+	first, second, third := &CacheEntry{Key: "first"}, &CacheEntry{Key: "second"}, &CacheEntry{Key: "third"}
+	policy.Added(first)
+	policy.Added(second)
+	policy.Added(third)
+	policy.Accessed(first)
+
+	if victim := policy.Victim(nil); victim != second {
+		t.Fatalf("expected second as victim, got %v", victim.Key)
+	}
+	if victim := policy.Victim(second); victim != third {
+		t.Fatalf("expected third as victim excluding second, got %v", victim.Key)
+	}
+	policy.Removed(second)
+	policy.Removed(third)
+	if victim := policy.Victim(first); victim != nil {
+		t.Fatalf("expected no victim except excluded entry, got %v", victim.Key)
+	}
+}
+
+func TestLFUPolicyEvictsLeastFrequentlyUsed(t *testing.T) {
+	policy := newTestPolicy(t, PolicyLFU)
+	frequent, rare, fresh := &CacheEntry{Key: "frequent"}, &CacheEntry{Key: "rare"}, &CacheEntry{Key: "fresh"}
+	policy.Added(frequent)
+	policy.Added(rare)
+	for idx := 0; idx < 3; idx++ {
+		policy.Accessed(frequent)
+	}
+	policy.Accessed(rare)
+	policy.Added(fresh)
+
+	if victim := policy.Victim(nil); victim != fresh {
+		t.Fatalf("expected fresh as victim, got %v", victim.Key)
+	}
+	// Исключение записи не меняет её историю обращений
+	if victim := policy.Victim(fresh); victim != rare {
+		t.Fatalf("expected rare as victim excluding fresh, got %v", victim.Key)
+	}
+	if fresh.frequency != 1 || frequent.frequency != 4 || rare.frequency != 2 {
+		t.Fatalf("victim lookup changed frequencies: fresh %v, frequent %v, rare %v",
+			fresh.frequency, frequent.frequency, rare.frequency)
+	}
+}
+
+func TestTTLPolicyEvictsEarliestExpiration(t *testing.T) {
+	policy := newTestPolicy(t, PolicyTTL)
+	now := time.Now()
+	late := &CacheEntry{Key: "late", ExpiresAt: now.Add(time.Hour * 3)}
+	early := &CacheEntry{Key: "early", ExpiresAt: now.Add(time.Hour)}
+	middle := &CacheEntry{Key: "middle", ExpiresAt: now.Add(time.Hour * 2)}
+	policy.Added(late)
+	policy.Added(early)
+	policy.Added(middle)
+
+	if victim := policy.Victim(nil); victim != early {
+		t.Fatalf("expected early as victim, got %v", victim.Key)
+	}
+	if victim := policy.Victim(early); victim != middle {
+		t.Fatalf("expected middle as victim excluding early, got %v", victim.Key)
+	}
+
+	// Перезапись продлевает срок жизни записи
+	early.ExpiresAt = now.Add(time.Hour * 4)
+	policy.Accessed(early)
+	if victim := policy.Victim(nil); victim != middle {
+		t.Fatalf("expected middle as victim after early is prolonged, got %v", victim.Key)
+	}
+}
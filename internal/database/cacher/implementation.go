@@ -1,9 +1,10 @@
 package cacher
 
-// Интерфейс для работы с хранилищем кэша
+import ch "github.com/nehachuha1/wbtech-tasks/internal/handlers"
+
+// Интерфейс для работы с хранилищем кэша: репозиторий заказов и служебные методы
 type CacheController interface {
-	GetDataFromTable(out chan interface{}, key string)
-	SetDataToTable(out chan interface{}, data []byte)
-	ClearCache() interface{}
-	LoadOrdersToCache(data []byte)
+	ch.OrderRepository
+	SwapEntries(orders []*ch.Order) int
+	ClearCache()
 }
@@ -0,0 +1,202 @@
+package cacher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Формат снапшота кэша (все числа - big endian):
+//
+//	magic "WBCS" | версия uint16 | watermark int64 (unix nano) | число записей uint32 |
+//	записи: длина ключа uint32, ключ, длина значения uint32, значение, expires_at int64 (0 - бессрочно) |
+//	crc32 (IEEE) всего, что идёт до неё
+const (
+	snapshotMagic   = "WBCS"
+	snapshotVersion = 1
+)
+
+var (
+	ErrSnapshotCorrupted = errors.New("cache snapshot is corrupted")
+	ErrSnapshotVersion   = errors.New("unsupported cache snapshot version")
+)
+
+// Метод для записи снапшота кэша на диск. Вместе с записями сохраняется watermark - отметка, до которой кэш
+// согласован с Postgres. Файл сначала пишется во временный и только потом переименовывается, поэтому при падении
+// посреди записи на диске остаётся предыдущий целый снапшот. Возвращает число сохранённых записей
+func (cache *CacheVault) WriteSnapshot(path string, watermark time.Time) (int, error) {
+	cache.mu.Lock()
+	entries := make([]*CacheEntry, 0, len(cache.Data))
+	for _, entry := range cache.Data {
+		entries = append(entries, &CacheEntry{Key: entry.Key, Value: entry.Value, ExpiresAt: entry.ExpiresAt})
+	}
+	cache.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return 0, err
+	}
+
+	checksum := crc32.NewIEEE()
+	buffer := bufio.NewWriter(io.MultiWriter(file, checksum))
+	err = encodeSnapshot(buffer, entries, watermark)
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err == nil {
+		err = binary.Write(file, binary.BigEndian, checksum.Sum32())
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return 0, err
+	}
+	return len(entries), os.Rename(tempPath, path)
+}
+
+// Метод для загрузки снапшота кэша с диска. Записи с истёкшим сроком жизни пропускаются, остальные
+// записываются в кэш одной пачкой. Возвращает watermark снапшота - с неё нужно продолжить обновление из Postgres
+func (cache *CacheVault) LoadSnapshot(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(data) < len(snapshotMagic)+2+8+4+4 {
+		return time.Time{}, ErrSnapshotCorrupted
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return time.Time{}, ErrSnapshotCorrupted
+	}
+
+	entries, watermark, err := decodeSnapshot(bytes.NewReader(body))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, entry := range entries {
+		if entry.isExpired(now) {
+			continue
+		}
+		cache.setEntryLocked(entry.Key, entry.Value)
+		if stored, isExists := cache.Data[entry.Key]; isExists && !entry.ExpiresAt.IsZero() {
+			stored.ExpiresAt = entry.ExpiresAt
+			cache.Policy.Accessed(stored)
+		}
+	}
+	return watermark, nil
+}
+
+func encodeSnapshot(w io.Writer, entries []*CacheEntry, watermark time.Time) error {
+	header := []any{[]byte(snapshotMagic), uint16(snapshotVersion), unixNano(watermark), uint32(len(entries))}
+	for _, value := range header {
+		if err := binary.Write(w, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		fields := []any{
+			uint32(len(entry.Key)), []byte(entry.Key),
+			uint32(len(entry.Value)), entry.Value,
+			unixNano(entry.ExpiresAt),
+		}
+		for _, value := range fields {
+			if err := binary.Write(w, binary.BigEndian, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeSnapshot(r *bytes.Reader) ([]*CacheEntry, time.Time, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, time.Time{}, ErrSnapshotCorrupted
+	}
+	var version uint16
+	var watermark int64
+	var count uint32
+	if err := readFields(r, &version, &watermark, &count); err != nil {
+		return nil, time.Time{}, err
+	}
+	if version != snapshotVersion {
+		return nil, time.Time{}, fmt.Errorf("%w: %v", ErrSnapshotVersion, version)
+	}
+
+	entries := make([]*CacheEntry, 0, min(int(count), r.Len()/16))
+	for i := uint32(0); i < count; i++ {
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		value, err := readBytes(r)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var expiresAt int64
+		if err := readFields(r, &expiresAt); err != nil {
+			return nil, time.Time{}, err
+		}
+		entries = append(entries, &CacheEntry{Key: string(key), Value: value, ExpiresAt: fromUnixNano(expiresAt)})
+	}
+	if r.Len() != 0 {
+		return nil, time.Time{}, ErrSnapshotCorrupted
+	}
+	return entries, fromUnixNano(watermark), nil
+}
+
+func readFields(r *bytes.Reader, fields ...any) error {
+	for _, field := range fields {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return ErrSnapshotCorrupted
+		}
+	}
+	return nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	var length uint32
+	if err := readFields(r, &length); err != nil {
+		return nil, err
+	}
+	if int(length) > r.Len() {
+		return nil, ErrSnapshotCorrupted
+	}
+	data := make([]byte, length)
+	_, _ = io.ReadFull(r, data)
+	return data, nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(value int64) time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, value)
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+)
+
+// Состояние компонентов менеджера данных для проверки готовности сервиса:
+// - postgres: база отвечает на пинг;
+// - consumer: получатель подключён к consumer group кафки;
+// - cache: начальная загрузка кэша завершена;
+// - data_manager: менеджер не начал остановку (готовность пропадает сразу, ещё до остановки получателя).
+// Менеджер готов, только если готовы все компоненты
+func (dm *DataManager) Readiness(ctx context.Context) []handlers.ComponentStatus {
+	postgres := handlers.ComponentStatus{Name: "postgres", Ready: true}
+	if err := dm.postgresDB.Ping(ctx); err != nil {
+		postgres.Ready = false
+		postgres.Detail = err.Error()
+	}
+
+	cache := handlers.ComponentStatus{Name: "cache", Ready: true}
+	select {
+	case <-dm.warmedUp:
+	default:
+		cache.Ready = false
+		cache.Detail = "cache warm-up is in progress"
+	}
+
+	dm.mu.RLock()
+	messageConsumer := handlers.ComponentStatus{Name: "consumer", Ready: dm.consumer != nil,
+		Detail: dm.consumerStatus}
+	dataManager := handlers.ComponentStatus{Name: "data_manager", Ready: !dm.isDetached && !dm.isClosing}
+	dm.mu.RUnlock()
+	if !dataManager.Ready {
+		dataManager.Detail = ErrShuttingDown.Error()
+	}
+	return []handlers.ComponentStatus{postgres, messageConsumer, cache, dataManager}
+}
@@ -1,50 +1,106 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/IBM/sarama"
 	"github.com/nehachuha1/wbtech-tasks/internal/config"
 	cache "github.com/nehachuha1/wbtech-tasks/internal/database/cacher"
 	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/consumer"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
 	pg "github.com/nehachuha1/wbtech-tasks/internal/database/postgres"
 	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
 	pgmigrate "github.com/nehachuha1/wbtech-tasks/internal/migrations/postgres"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"github.com/nehachuha1/wbtech-tasks/pkg/retry"
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 )
 
+// Ошибка, которую возвращают методы DataManager после начала остановки сервиса
+var ErrShuttingDown = errors.New("data manager is shutting down")
+
 // Структуру "менеджера данных". С её помощью конкурентно будем обрабатывать входящие запросы на
-// сохранение/получение данных из кэша, добавление новых заказов в базу данных
+// сохранение/получение данных из кэша, добавление новых заказов в базу данных.
+// Сам DataManager реализует handlers.OrderRepository: запросы идут в композитный репозиторий (кэш + Postgres),
+// а менеджер следит за тем, чтобы после начала остановки новые запросы не принимались.
+// ctx живёт, пока работает менеджер: на нём идут фоновые запросы в Postgres, Shutdown его отменяет.
+// warmedUp закрывается после начальной загрузки кэша. consumerMu не даёт подключать двух получателей одновременно,
+// Shutdown его не берёт, чтобы не ждать подключения к брокеру. consumer, deadLetter, isDetached (начата остановка,
+// новых получателей не подключаем) и consumerStatus (почему получатель не подключён) защищены mu
 type DataManager struct {
-	Logger     *zap.SugaredLogger
-	postgresDB *pg.PostgresDatabase
-	cacheVault *cache.CacheVault
-	commands   map[string]func(chan interface{}, []byte)
-	Quit       chan bool
-	mu         sync.RWMutex
+	Logger         *zap.SugaredLogger
+	postgresDB     pg.IPostgresDatabase
+	cacheVault     *cache.CacheVault
+	orders         *ReadThroughRepository
+	consumer       consumer.MessageConsumer
+	deadLetter     producer.DeadLetterProducer
+	retryPolicy    retry.Policy
+	Quit           chan bool
+	mu             sync.RWMutex
+	inFlight       sync.WaitGroup
+	isClosing      bool
+	consumerMu     sync.Mutex
+	isDetached     bool
+	consumerStatus string
+	warmedUp       chan struct{}
+	refreshDone    chan struct{}
+	ctx            context.Context
+	cancel         context.CancelFunc
+	shutdownOnce   sync.Once
+	shutdownErr    error
 }
 
-// Инициализация хранилища кэша. В крутящейся горутине проверяем, не было ли сигнала на прекращение работы сервиса
+// Инициализация хранилища кэша. Если задан срок жизни записей, в крутящейся горутине периодически удаляем
+// устаревшие записи. Там же проверяем, не было ли сигнала на прекращение работы сервиса
 func NewCacheVault(cfg *config.CacheConfig, logger *zap.SugaredLogger) *cache.CacheVault {
+	policyName := cfg.EvictionPolicy
+	if policyName == cache.PolicyTTL && cfg.EntryTTL <= 0 {
+		logger.Warn("ttl cache eviction policy requires CACHE_ENTRY_TTL, falling back to lru")
+		policyName = cache.PolicyLRU
+	}
+	policy, err := cache.NewEvictionPolicy(policyName)
+	if err != nil {
+		logger.Warnw("unknown cache eviction policy, falling back to lru", "error", err)
+		policy, _ = cache.NewEvictionPolicy(cache.PolicyLRU)
+	}
+
 	cacheVault := &cache.CacheVault{
-		Data:          make(map[string][]byte),
+		Data:          make(map[string]*cache.CacheEntry),
+		Policy:        policy,
 		ClearInterval: cfg.ClearInterval,
 		CacheLimit:    cfg.CacheLimit,
+		ByteLimit:     cfg.ByteLimit,
+		EntryTTL:      cfg.EntryTTL,
 		Logger:        logger,
 		Quit:          make(chan bool),
 	}
 
 	go func() {
+		var expired <-chan time.Time
+		if cacheVault.EntryTTL > 0 {
+			// При TTL меньше двух наносекунд половина TTL равна нулю, а тикер с нулевым периодом паникует
+			every := time.NewTicker(max(cacheVault.EntryTTL/2, time.Millisecond))
+			defer every.Stop()
+			expired = every.C
+		}
 		for {
 			select {
 			case <-cacheVault.Quit:
 				logger.Info("cleared cache vault and exited")
 				cacheVault.ClearCache()
 				return
+			case <-expired:
+				if removed := cacheVault.RemoveExpired(); removed > 0 {
+					logger.Infow("removed expired orders from cache", "removed", removed)
+				}
 			}
 		}
 	}()
@@ -66,177 +122,454 @@ func NewPostgresDB(cfg *config.PostgresConfig, logger *zap.SugaredLogger) *pg.Po
 
 	dbConn, err := gorm.Open(postgres.Open(newDSN), &gorm.Config{})
 	if err != nil {
-		panic(fmt.Sprintf("can't initialize connection to postgres"))
+		panic(fmt.Sprintf("can't initialize connection to postgres: %v", err))
+	}
+	if err = dbConn.Use(pg.QueryMetrics{}); err != nil {
+		logger.Warnw("postgres query metrics are disabled", "error", err)
 	}
 
 	newPostgresDatabase := &pg.PostgresDatabase{
 		DatabaseConnection: dbConn,
 		Logger:             logger,
-		Quit:               make(chan bool),
+		ConflictPolicy:     cfg.ConflictPolicy,
+		QueryTimeout:       cfg.QueryTimeout,
 	}
-
-	go func() {
-		<-newPostgresDatabase.Quit
-		db, _ := newPostgresDatabase.DatabaseConnection.DB()
-		db.Close()
-		logger.Info("connection to postgres closed")
-		return
-	}()
 	return newPostgresDatabase
 }
 
-// Функция, котороая обрабатывает все входящие запросы на данные. В её арсенале ей мапа хэндлеров кэша и постгреса.
-// Через горутины она делает запросы в постгрес и кэш, логика работы следующая:
-// При обработке createOrder:
-// 1. Запрос в Postgres. Если запрос был успешен, то создается горутина на добавление заказа в кэш
-// 2. Проверяется, успешно ли было сохранение данных в кэш
-// При обработке getOrder:
-// 1. Сначала идём в кэш и пытаемся получить заказ из него. При успехе возвращаем данные из кэша
-// 2. Если заказ не найден в кэше, то делаем запрос в постгрес, а далее добавляем заказ в кэш
-//
-// Если входящая команда не может быть обработана, то мы просто возвращаем nil
-func (dm *DataManager) RunQuery(cmd string, data []byte, queryOut chan []byte) {
-	defer close(queryOut)
+func (dm *DataManager) Create(ctx context.Context, order *handlers.Order) error {
+	done, err := dm.beginQuery()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return dm.orders.Create(ctx, order)
+}
+
+func (dm *DataManager) Get(ctx context.Context, orderUid string) (*handlers.Order, error) {
+	done, err := dm.beginQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return dm.orders.Get(ctx, orderUid)
+}
+
+func (dm *DataManager) GetMany(ctx context.Context, orderUids []string) ([]*handlers.Order, error) {
+	done, err := dm.beginQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return dm.orders.GetMany(ctx, orderUids)
+}
+
+func (dm *DataManager) List(ctx context.Context, filter *handlers.OrdersFilter) (*handlers.OrdersPage, error) {
+	done, err := dm.beginQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return dm.orders.List(ctx, filter)
+}
+
+// Регистрация нового запроса. Если менеджер данных уже останавливается, то запрос отклоняется с ErrShuttingDown,
+// иначе он учитывается в inFlight до вызова done
+func (dm *DataManager) beginQuery() (func(), error) {
 	dm.mu.RLock()
-	out := make(chan interface{})
-	if _, isExists := dm.commands[cmd]; isExists {
-		dm.mu.RUnlock()
-		dm.Logger.Info(fmt.Sprintf("running query: %v", cmd))
-		switch cmd {
-		case "createOrder":
-			go dm.commands["createOrder"](out, data)
-			pgOut := (<-out).(*handlers.QueryResult)
-
-			if pgOut.IsSuccessQuery {
-				dm.Logger.Info(fmt.Sprintf("successfully runned query: %v, trying to save result in cache", cmd))
-
-				cacheChan := make(chan interface{})
-				go dm.cacheVault.SetDataToTable(cacheChan, data)
-
-				cacheSuccess := (<-cacheChan).(*handlers.CacheQueryResult)
-				if cacheSuccess.IsSuccessQuery {
-					dm.Logger.Info("successfully saved query data in cache")
-				} else {
-					dm.Logger.Warn("failed in save query data in cache")
-				}
-			} else {
-				dm.Logger.Info(fmt.Sprintf("failed in running query %v", cmd))
-			}
-			queryOut <- pgOut.Data
-			return
-		case "getOrder":
-			currentOrder := &handlers.Order{}
-			if err := json.Unmarshal(data, currentOrder); errors.Is(err, nil) {
-				cacheChan := make(chan interface{})
-				go dm.cacheVault.GetDataFromTable(cacheChan, currentOrder.OrderUid)
-				cacheResult := (<-cacheChan).(*handlers.CacheQueryResult)
-				if cacheResult.IsSuccessQuery && cacheResult.Data != nil {
-					dm.Logger.Info(fmt.Sprintf("got data from cache for order with id %v",
-						currentOrder.OrderUid))
-					queryOut <- cacheResult.Data
-					return
-				}
-				dm.Logger.Info(fmt.Sprintf("failed to get data from cache for order_uid %v", currentOrder.OrderUid))
-				go dm.commands["getOrder"](out, data)
-				pgOut := (<-out).(*handlers.QueryResult)
-				if pgOut.IsSuccessQuery && pgOut.Data != nil {
-					cacheChan = make(chan interface{})
-					go dm.cacheVault.SetDataToTable(cacheChan, pgOut.Data)
-				}
+	defer dm.mu.RUnlock()
+	if dm.isClosing {
+		return nil, ErrShuttingDown
+	}
+	dm.inFlight.Add(1)
+	return dm.inFlight.Done, nil
+}
 
-				queryOut <- pgOut.Data
-				return
-			} else {
-				dm.Logger.Info("failed to unmarshal data from json to struct")
-				queryOut <- nil
-				return
-			}
-		default:
-			queryOut <- nil
-			return
-		}
-	} else {
-		dm.Logger.Info(fmt.Sprintf("there's no query %v in DataManager", cmd))
-		dm.mu.RUnlock()
-		queryOut <- nil
-		return
+// Обработчик сообщения из кафки: проверяем, что в сообщении валидный заказ (невалидные сразу отправляются
+// в dead-letter топик), и создаём новый заказ. Повторно присланный заказ с тем же содержимым считается обработанным.
+// Временные ошибки (недоступность Postgres, дедлоки) повторяем по политике повторов. Если заказ не удалось записать
+// из-за постоянной ошибки (например, конфликт по order_uid), то сообщение уходит в dead-letter топик вместе
+// с причиной ошибки и считается обработанным.
+// Ошибку возвращаем, когда временная ошибка не прошла за все попытки, сервис останавливается или брокер
+// dead-letter топика временно недоступен - offset сообщения не будет закоммичен, и сообщение будет обработано
+// повторно. Постоянные ошибки не возвращаем никогда, чтобы одно сообщение не остановило партицию (см. pushToDeadLetter).
+// Correlation ID берётся из заголовка сообщения (его ставит обработчик создания заказа), а если его нет - генерируется,
+// и дальше передаётся через ctx в кэш и Postgres
+func (dm *DataManager) processMessage(ctx context.Context, message *sarama.ConsumerMessage) error {
+	correlationID := producer.CorrelationIDFromHeaders(message)
+	if correlationID == "" {
+		correlationID = log.NewCorrelationID()
+	}
+	ctx = log.WithCorrelationID(ctx, correlationID)
+	logger := log.FromContext(ctx, dm.Logger).With("topic", message.Topic, "partition", message.Partition,
+		"offset", message.Offset)
+	logger.Info("received message in data manager, starting processing")
+
+	order, failure := parseMessage(message.Value)
+	if failure != nil {
+		logger.Warnw("message is not a valid order", "stage", failure.Stage, "error", failure.Error)
+		attempts := producer.AttemptsFromHeaders(message) + 1
+		return dm.pushToDeadLetter(logger, message, failure, attempts)
+	}
+
+	attempts, err := dm.retryPolicy.Do(ctx, func() error {
+		return dm.Create(ctx, order)
+	}, handlers.IsTransient)
+	if err == nil || errors.Is(err, handlers.ErrDuplicate) {
+		logger.Infow("successfully created new order", "order_uid", order.OrderUid, "attempts", attempts)
+		return nil
+	}
+	if errors.Is(err, ErrShuttingDown) || errors.Is(err, context.Canceled) || handlers.IsTransient(err) {
+		return fmt.Errorf("failed on creating new order after %v attempts: %v", attempts, err)
+	}
+
+	failure = handlers.FailureFromError(err)
+	logger.Warnw("failed on creating new order", "order_uid", order.OrderUid, "stage", failure.Stage,
+		"error", failure.Error)
+	attempts += producer.AttemptsFromHeaders(message)
+	return dm.pushToDeadLetter(logger, message, failure, attempts)
+}
+
+// Отправка сообщения в dead-letter топик. Ошибка возвращается, только если брокер временно недоступен:
+// тогда offset не коммитится и сообщение придёт ещё раз. Если топика нет (менеджер собран без кафки)
+// или брокер отказался принять сообщение насовсем (например, оно слишком большое), то повтор ничего не даст
+// и остановит всю партицию - такое сообщение пишем в лог и считаем обработанным
+func (dm *DataManager) pushToDeadLetter(logger *zap.SugaredLogger, message *sarama.ConsumerMessage,
+	failure *handlers.QueryFailure, attempts int) error {
+	if dm.deadLetter == nil {
+		logger.Errorw("dead-letter topic is not configured, dropping message", "stage", failure.Stage,
+			"error", failure.Error, "attempts", attempts)
+		return nil
+	}
+	err := dm.deadLetter.PushToDeadLetter(message, failure, attempts)
+	if err != nil && producer.IsTransientError(err) {
+		return fmt.Errorf("failed on sending message to dead-letter topic: %v", err)
+	}
+	if err != nil {
+		logger.Errorw("dead-letter topic rejected message, dropping it", "stage", failure.Stage,
+			"error", failure.Error, "attempts", attempts, "dead_letter_error", err)
 	}
+	return nil
 }
 
-// Инициализация обработчик для Postgres, данная мапа используется в RunQuery
-func (dm *DataManager) InitHandlers() {
-	dm.Logger.Info("initialized database handlers")
-	dm.commands = map[string]func(chan interface{}, []byte){
-		"createOrder": dm.postgresDB.CreateOrder,
-		"getOrder":    dm.postgresDB.GetOrder,
+// Разбор сообщения из очереди: в топик могут отправить что угодно, а не только наш обработчик создания заказа.
+// Возвращает заказ, приведённый к виду хранения (см. Order.Normalize), если он валиден, иначе - отчёт об ошибке
+func parseMessage(data []byte) (*handlers.Order, *handlers.QueryFailure) {
+	order := &handlers.Order{}
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, &handlers.QueryFailure{Stage: pg.StageUnmarshal, Code: pg.ErrOnUnmarshal, Error: err.Error()}
 	}
+	if validationErrs := order.Validate(); validationErrs != nil {
+		return nil, &handlers.QueryFailure{
+			Stage: handlers.StageValidation,
+			Code:  http.StatusUnprocessableEntity,
+			Error: validationErrs.Error(),
+		}
+	}
+	order.Normalize()
+	return order, nil
 }
 
 // Инициализаия новой управляющей структуры для работы с данными. В неё грузим конфиги для Postgres, хранилища кэша
 // и кафки. Внутри себя структура имеет логгер и управляющие структуры для Postgres и кэша.
-// В начале инициализации мы запускам миграции. Далее грузим имеющиеся заказы в кэш.
-// В горутине ловятся сообщения с кафки и в дальнешейм перенаправляются в RunQuery на создание нового заказа.
-// Также в этой горутине есть тикер, который под собой имеет интервал очищения кэша. При срабатывании тикера
-// делается запрос в Postgres на получение всех заказов, хранилище кэша очищается и обновляется
+// В начале инициализации мы запускам миграции. Остальное происходит в фоне (см. start), чтобы сервер мог
+// отвечать на /healthz и /readyz, пока грузится кэш: загружаем имеющиеся заказы в кэш (см. warmUpCache),
+// после этого подключаемся к consumer group кафки (заказы из сообщений создаются через processMessage)
+// и запускаем фоновое обновление кэша (см. runRefresh)
 func NewDataManager(pgCfg *config.PostgresConfig, cacheCfg *config.CacheConfig, kafkaConfig *config.KafkaConfig,
-	logger *zap.SugaredLogger) *DataManager {
+	retryCfg *config.RetryConfig, logger *zap.SugaredLogger) *DataManager {
 	newPostgres := NewPostgresDB(pgCfg, logger)
-	newCacheVault := NewCacheVault(cacheCfg, logger)
+	pgmigrate.MakeMigrations(newPostgres.DatabaseConnection)
 
-	newKafkaWorker := consumer.NewKafkaConsumer(kafkaConfig, logger)
-	kafkaQuitChannel := make(chan bool)
-	kafkaConsumer, _ := newKafkaWorker.InitializeConsumer(kafkaQuitChannel)
+	dataManager := newDataManager(newPostgres, NewCacheVault(cacheCfg, logger), retryCfg, logger)
 
-	dataManager := &DataManager{
-		Logger:     logger,
-		postgresDB: newPostgres,
-		cacheVault: newCacheVault,
-		Quit:       make(chan bool),
+	// В dead-letter топик пишем только синхронно и без outbox: offset исходного сообщения можно коммитить лишь после
+	// подтверждения от брокера
+	deadLetterConfig := *kafkaConfig
+	deadLetterConfig.ProducerAsync = false
+	deadLetterConfig.OutboxPath = ""
+	kafkaConsumer := consumer.NewKafkaConsumer(kafkaConfig, logger)
+	deadLetter := producer.NewKafkaProducer(&deadLetterConfig, logger)
+
+	go dataManager.start(cacheCfg, func() {
+		dataManager.attachWithRetry(kafkaConsumer, deadLetter, kafkaConfig.RetryInterval)
+	})
+	return dataManager
+}
+
+// Подключение получателя сообщений и продюсера dead-letter топика: заказы из сообщений создаются через
+// processMessage. Менеджер становится их владельцем и закрывает их в Shutdown (продюсера - даже если получателя
+// подключить не удалось). После начала остановки возвращает ErrShuttingDown. Подключение к брокеру идёт
+// без блокировки mu; если за это время началась остановка, то получатель сразу закрывается
+func (dm *DataManager) AttachConsumer(messageConsumer consumer.MessageConsumer,
+	deadLetter producer.DeadLetterProducer) error {
+	dm.consumerMu.Lock()
+	defer dm.consumerMu.Unlock()
+	dm.mu.Lock()
+	if dm.isDetached {
+		dm.mu.Unlock()
+		return ErrShuttingDown
 	}
+	dm.deadLetter = deadLetter
+	dm.mu.Unlock()
 
-	dataManager.InitHandlers()
-	pgmigrate.MakeMigrations(newPostgres.DatabaseConnection)
-	tempChannel := make(chan interface{})
-	go dataManager.postgresDB.GrepOrdersFromDatabase(tempChannel)
-	toLoadCacheResult := (<-tempChannel).(*handlers.QueryResult)
-	if toLoadCacheResult.IsSuccessQuery && toLoadCacheResult.Data != nil {
-		newCacheVault.LoadOrdersToCache(toLoadCacheResult.Data)
-		logger.Info("starting pre-load orders to cache")
+	err := messageConsumer.InitializeConsumer(dm.processMessage)
+
+	dm.mu.Lock()
+	if err != nil {
+		dm.consumerStatus = err.Error()
+		dm.mu.Unlock()
+		return err
 	}
+	if dm.isDetached {
+		dm.mu.Unlock()
+		messageConsumer.Close()
+		return ErrShuttingDown
+	}
+	dm.consumer = messageConsumer
+	dm.consumerStatus = ""
+	dm.mu.Unlock()
+	return nil
+}
 
-	go func() {
-		every := time.NewTicker(newCacheVault.ClearInterval)
-		for {
-			select {
-			case inputData := <-kafkaConsumer.Messages():
-				dataManager.Logger.Info(
-					fmt.Sprintf("Received message in data manager from queue, starting processing"))
-				returnChannel := make(chan []byte)
-				go dataManager.RunQuery("createOrder", inputData.Value, returnChannel)
-				result := <-returnChannel
-				if result == nil {
-					dataManager.Logger.Info("Successfully created new order")
-				} else {
-					dataManager.Logger.Info(fmt.Sprintf("failed on creating new order: %v", result))
-				}
-			case <-dataManager.Quit:
-				dataManager.Logger.Info("closed connection to Postgres and CacheVault")
-				dataManager.postgresDB.Quit <- true
-				dataManager.cacheVault.Quit <- true
-				kafkaQuitChannel <- true
-				break
-			case <-every.C:
-				logger.Info("started cleaning cache")
-				newCacheVault.ClearCache()
-				ch := make(chan interface{})
-				go dataManager.postgresDB.GrepOrdersFromDatabase(ch)
-				result := (<-ch).(*handlers.QueryResult)
-				if result.IsSuccessQuery && result.Data != nil {
-					newCacheVault.LoadOrdersToCache(result.Data)
-				}
-			}
+// Подключение получателя с повторами раз в retryInterval: если кафка недоступна при старте, сервис продолжает
+// работать (отдавать заказы), но не готов (см. Readiness), пока не подключится. Повторы прекращаются при остановке
+func (dm *DataManager) attachWithRetry(messageConsumer consumer.MessageConsumer,
+	deadLetter producer.DeadLetterProducer, retryInterval time.Duration) {
+	for {
+		err := dm.AttachConsumer(messageConsumer, deadLetter)
+		if err == nil || errors.Is(err, ErrShuttingDown) {
+			return
 		}
-	}()
+		dm.Logger.Warnw("orders won't be consumed from queue until consumer is attached", "error", err)
+		select {
+		case <-time.After(retryInterval):
+		case <-dm.ctx.Done():
+			return
+		}
+	}
+}
+
+// Сборка менеджера данных поверх готового хранилища заказов, например pg.MemoryDatabase в тестах.
+// Кэш так же грузится из store в фоне и обновляется, но к кафке менеджер не подключается - получателя
+// сообщений и dead-letter топик можно подключить через AttachConsumer. Окончания загрузки кэша можно
+// дождаться через WarmedUp
+func NewDataManagerWithStore(store pg.IPostgresDatabase, cacheCfg *config.CacheConfig, retryCfg *config.RetryConfig,
+	logger *zap.SugaredLogger) *DataManager {
+	dataManager := newDataManager(store, NewCacheVault(cacheCfg, logger), retryCfg, logger)
+	go dataManager.start(cacheCfg, nil)
+	return dataManager
+}
 
+// Фоновый запуск менеджера: начальная загрузка кэша, затем подключение к кафке через attach (если задан)
+// и обновление кэша до остановки
+func (dm *DataManager) start(cacheCfg *config.CacheConfig, attach func()) {
+	watermark, fromSnapshot := dm.warmUpCache(cacheCfg)
+	if attach != nil {
+		go attach()
+	}
+	dm.runRefresh(cacheCfg, watermark, fromSnapshot)
+}
+
+// Канал, который закрывается после начальной загрузки кэша
+func (dm *DataManager) WarmedUp() <-chan struct{} {
+	return dm.warmedUp
+}
+
+func newDataManager(store pg.IPostgresDatabase, cacheVault *cache.CacheVault, retryCfg *config.RetryConfig,
+	logger *zap.SugaredLogger) *DataManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	dataManager := &DataManager{
+		Logger:         logger,
+		postgresDB:     store,
+		cacheVault:     cacheVault,
+		retryPolicy:    retryCfg.Policy(),
+		Quit:           make(chan bool),
+		consumerStatus: "consumer is not attached",
+		warmedUp:       make(chan struct{}),
+		refreshDone:    make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	dataManager.orders = &ReadThroughRepository{Cache: cacheVault, Store: store, Logger: logger}
 	return dataManager
 }
+
+// Начальная загрузка кэша. Если есть снапшот кэша, то сервис стартует с ним, а сверка с Postgres идёт уже в фоне.
+// Без снапшота из Postgres до старта грузятся последние записанные заказы, сколько поместится в кэш (CacheLimit),
+// остальные попадут в кэш при первом чтении. Возвращает отметку, с которой продолжится обновление.
+// По завершении (в том числе неудачном - тогда кэш догрузится при следующем обновлении) закрывается warmedUp
+func (dm *DataManager) warmUpCache(cacheCfg *config.CacheConfig) (time.Time, bool) {
+	defer close(dm.warmedUp)
+	watermark, fromSnapshot := dm.loadSnapshot(cacheCfg.SnapshotPath)
+	if !fromSnapshot {
+		dm.Logger.Info("starting pre-load orders to cache")
+		watermark = dm.refreshCache(time.Time{}, 0)
+	}
+	dm.Logger.Infow("cache warm-up finished", "from_snapshot", fromSnapshot)
+	return watermark, fromSnapshot
+}
+
+// Фоновое обновление кэша. Крутится тикер, который под собой имеет интервал обновления кэша. При срабатывании
+// тикера из Postgres подтягиваются только заказы, записанные после предыдущего обновления (см. refreshCache).
+// Второй тикер периодически пишет снапшот (если SnapshotInterval больше нуля), последний снапшот пишется при остановке.
+// Завершается по сигналу в Quit (его отправляет Shutdown)
+func (dm *DataManager) runRefresh(cacheCfg *config.CacheConfig, watermark time.Time, fromSnapshot bool) {
+	defer close(dm.refreshDone)
+	every := time.NewTicker(dm.cacheVault.ClearInterval)
+	defer every.Stop()
+	var snapshotTick <-chan time.Time
+	if cacheCfg.SnapshotPath != "" && cacheCfg.SnapshotInterval > 0 {
+		snapshotEvery := time.NewTicker(cacheCfg.SnapshotInterval)
+		defer snapshotEvery.Stop()
+		snapshotTick = snapshotEvery.C
+	}
+	if fromSnapshot {
+		dm.Logger.Info("started reconciling cache snapshot with postgres")
+		watermark = dm.refreshCache(watermark, cacheCfg.RefreshOverlap)
+	}
+	for {
+		select {
+		case <-dm.Quit:
+			dm.Logger.Info("stopped cache refreshing")
+			dm.writeSnapshot(cacheCfg.SnapshotPath, watermark)
+			return
+		case <-every.C:
+			dm.Logger.Info("started refreshing cache")
+			watermark = dm.refreshCache(watermark, cacheCfg.RefreshOverlap)
+		case <-snapshotTick:
+			dm.writeSnapshot(cacheCfg.SnapshotPath, watermark)
+		}
+	}
+}
+
+// Инкрементальное обновление кэша. Из Postgres берутся заказы, записанные позже watermark - overlap, и одной
+// пачкой записываются в кэш поверх старых: кэш не очищается, поэтому читатели никогда не видят его пустым.
+// Нулевой watermark - загрузка последних CacheLimit заказов: более старые кэш всё равно бы вытеснил.
+// Возвращает новую отметку; при ошибке отметка не сдвигается
+func (dm *DataManager) refreshCache(watermark time.Time, overlap time.Duration) time.Time {
+	since, limit := watermark, 0
+	if since.IsZero() {
+		limit = int(dm.cacheVault.CacheLimit)
+	} else {
+		since = since.Add(-overlap)
+	}
+
+	changes, err := dm.postgresDB.ListUpdatedSince(dm.ctx, since, limit)
+	if err != nil {
+		dm.Logger.Warnw("failed on refreshing cache", "error", err)
+		return watermark
+	}
+	saved := dm.cacheVault.SwapEntries(changes.Orders)
+	dm.Logger.Infow("refreshed cache", "count", saved, "watermark", changes.Watermark)
+
+	if changes.Watermark.After(watermark) {
+		return changes.Watermark
+	}
+	return watermark
+}
+
+// Загрузка кэша из снапшота. Если снапшоты выключены, файла нет или он повреждён, возвращается false,
+// и кэш нужно загрузить из Postgres
+func (dm *DataManager) loadSnapshot(path string) (time.Time, bool) {
+	if path == "" {
+		return time.Time{}, false
+	}
+	watermark, err := dm.cacheVault.LoadSnapshot(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			dm.Logger.Warnw("failed on loading cache snapshot", "path", path, "error", err)
+		}
+		return time.Time{}, false
+	}
+	dm.Logger.Infow("loaded cache snapshot", "path", path, "watermark", watermark.Format(time.RFC3339))
+	return watermark, true
+}
+
+// Запись снапшота кэша на диск, если снапшоты включены
+func (dm *DataManager) writeSnapshot(path string, watermark time.Time) {
+	if path == "" {
+		return
+	}
+	saved, err := dm.cacheVault.WriteSnapshot(path, watermark)
+	if err != nil {
+		dm.Logger.Warnw("failed on writing cache snapshot", "path", path, "error", err)
+		return
+	}
+	dm.Logger.Infow("wrote cache snapshot", "path", path, "count", saved)
+}
+
+// Остановка менеджера данных при завершении работы сервиса. Порядок важен:
+// 1. Менеджер перестаёт быть готовым (см. Readiness), получатель кафки больше не подключается (если ещё не подключён),
+// а подключённый останавливается - он дообрабатывает текущие сообщения и коммитит offset'ы
+// 2. Новые запросы больше не принимаются, ждём завершения уже запущенных
+// 3. Останавливаем обновление кэша (идущая выборка из Postgres отменяется, снапшот записывается), закрываем продюсера dead-letter топика, кэш
+// и пул соединений с Postgres
+// Если ctx истёк раньше, чем завершились запросы, то ресурсы всё равно закрываются, а возвращается ошибка ctx.
+// Остановка выполняется один раз, повторный вызов дожидается первого и возвращает его результат
+func (dm *DataManager) Shutdown(ctx context.Context) error {
+	dm.shutdownOnce.Do(func() {
+		dm.shutdownErr = dm.shutdown(ctx)
+	})
+	return dm.shutdownErr
+}
+
+func (dm *DataManager) shutdown(ctx context.Context) error {
+	var errs []error
+	dm.mu.Lock()
+	dm.isDetached = true
+	messageConsumer, deadLetter := dm.consumer, dm.deadLetter
+	dm.mu.Unlock()
+	if messageConsumer != nil {
+		if err := waitWithContext(ctx, messageConsumer.Close); err != nil {
+			errs = append(errs, fmt.Errorf("failed on stopping consumer: %w", err))
+		}
+	}
+
+	dm.mu.Lock()
+	dm.isClosing = true
+	dm.mu.Unlock()
+	if err := waitWithContext(ctx, func() error {
+		dm.inFlight.Wait()
+		return nil
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("failed on draining in-flight queries: %w", err))
+	} else {
+		dm.Logger.Info("all in-flight queries finished")
+	}
+
+	// Дожидаемся, пока горутина обновления кэша запишет последний снапшот: после этого кэш будет очищен
+	dm.cancel()
+	select {
+	case dm.Quit <- true:
+		select {
+		case <-dm.refreshDone:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	if deadLetter != nil {
+		if err := deadLetter.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed on closing dead-letter producer: %w", err))
+		}
+	}
+	dm.cacheVault.Quit <- true
+	if err := dm.postgresDB.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed on closing postgres: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Вызов fn с ожиданием не дольше, чем живёт ctx. Если ctx истёк, то fn продолжает работать в фоне
+func waitWithContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
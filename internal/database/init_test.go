@@ -0,0 +1,310 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/IBM/sarama"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/consumer"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/memory"
+	pg "github.com/nehachuha1/wbtech-tasks/internal/database/postgres"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/testutil"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDataManager(t *testing.T, store pg.IPostgresDatabase) *DataManager {
+	t.Helper()
+	cacheCfg := &config.CacheConfig{
+		ClearInterval:  time.Hour,
+		CacheLimit:     100,
+		EvictionPolicy: "lru",
+	}
+	retryCfg := &config.RetryConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond * 5,
+		Multiplier:     2,
+	}
+	dataManager := NewDataManagerWithStore(store, cacheCfg, retryCfg, zap.NewNop().Sugar())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := dataManager.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	})
+	return dataManager
+}
+
+func newTestMessage(value []byte) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{Topic: "orders", Partition: 0, Offset: 1, Value: value}
+}
+
+func TestProcessMessageStoresAndCachesOrder(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := newTestDataManager(t, store)
+
+	if err := dataManager.processMessage(context.Background(), newTestMessage(testutil.OrderJSON("stored", testutil.DateCreated))); err != nil {
+		t.Fatalf("process message: %v", err)
+	}
+	if _, err := store.Get(context.Background(), "stored"); err != nil {
+		t.Fatalf("order is not stored: %v", err)
+	}
+	if _, err := dataManager.cacheVault.Get(context.Background(), "stored"); err != nil {
+		t.Fatalf("order is not cached: %v", err)
+	}
+
+	// Повторная доставка того же сообщения считается обработанной
+	if err := dataManager.processMessage(context.Background(), newTestMessage(testutil.OrderJSON("stored", testutil.DateCreated))); err != nil {
+		t.Fatalf("process duplicate message: %v", err)
+	}
+}
+
+func TestProcessMessageRetriesTransientErrors(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := newTestDataManager(t, store)
+	store.FailOn(pg.OpWrite, pg.StageCommit, &pgconn.PgError{Code: "40P01"}, 2)
+
+	if err := dataManager.processMessage(context.Background(), newTestMessage(testutil.OrderJSON("retried", testutil.DateCreated))); err != nil {
+		t.Fatalf("process message: %v", err)
+	}
+	if _, err := dataManager.Get(context.Background(), "retried"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+}
+
+func TestProcessMessageKeepsMessageWhenStoreIsUnavailable(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := newTestDataManager(t, store)
+	store.FailOn(pg.OpWrite, pg.StageLookup, &pgconn.PgError{Code: "08006"}, 0)
+
+	if err := dataManager.processMessage(context.Background(), newTestMessage(testutil.OrderJSON("lost", testutil.DateCreated))); err == nil {
+		t.Fatalf("expected error, message must not be committed")
+	}
+	store.ResetFailures()
+	if _, err := dataManager.Get(context.Background(), "lost"); !errors.Is(err, handlers.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestProcessMessageStopsOnMessageTimeout(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := newTestDataManager(t, store)
+	store.BeforeStage = func(ctx context.Context, op string, stage string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := dataManager.processMessage(ctx, newTestMessage(testutil.OrderJSON("slow", testutil.DateCreated)))
+	if err == nil {
+		t.Fatalf("expected error after message timeout")
+	}
+}
+
+func TestDataManagerWarmsUpCacheFromStore(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	order, failure := parseMessage(testutil.OrderJSON("preloaded", testutil.DateCreated))
+	if failure != nil {
+		t.Fatalf("parse: %v", failure.Error)
+	}
+	if err := store.Create(context.Background(), order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	dataManager := newTestDataManager(t, store)
+	select {
+	case <-dataManager.WarmedUp():
+	case <-time.After(time.Second * 5):
+		t.Fatalf("cache warm-up didn't finish")
+	}
+	if _, err := dataManager.cacheVault.Get(context.Background(), "preloaded"); err != nil {
+		t.Fatalf("order is not loaded to cache: %v", err)
+	}
+}
+
+func TestRefreshCacheKeepsWatermarkWhenAssemblyFails(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := newTestDataManager(t, store)
+	<-dataManager.WarmedUp()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	watermark := clock
+	for _, orderUid := range []string{"first", "second"} {
+		if err := store.Create(context.Background(), testutil.Order(t, orderUid, testutil.DateCreated)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	// Строки orders прочитались, а вещи - нет: отметка не должна сдвинуться за несобранные заказы
+	store.FailOn(pg.OpRead, pg.StageItems, errors.New("connection reset"), 1)
+	if refreshed := dataManager.refreshCache(watermark, 0); !refreshed.Equal(watermark) {
+		t.Fatalf("watermark moved to %v after failed refresh", refreshed)
+	}
+	if _, err := dataManager.cacheVault.Get(context.Background(), "first"); err == nil {
+		t.Fatalf("order is cached after failed refresh")
+	}
+
+	if refreshed := dataManager.refreshCache(watermark, 0); !refreshed.Equal(clock) {
+		t.Fatalf("expected watermark %v, got %v", clock, refreshed)
+	}
+	for _, orderUid := range []string{"first", "second"} {
+		if _, err := dataManager.cacheVault.Get(context.Background(), orderUid); err != nil {
+			t.Fatalf("order %v is not cached after refresh: %v", orderUid, err)
+		}
+	}
+}
+
+func TestDataManagerWritesSnapshotOnlyOnShutdownWithoutInterval(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	if err := store.Create(context.Background(), testutil.Order(t, "snapshotted", testutil.DateCreated)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	cacheCfg := &config.CacheConfig{
+		ClearInterval:  time.Hour,
+		CacheLimit:     100,
+		EvictionPolicy: "lru",
+		SnapshotPath:   filepath.Join(t.TempDir(), "cache.snapshot"),
+	}
+	dataManager := NewDataManagerWithStore(store, cacheCfg, &config.RetryConfig{MaxAttempts: 1},
+		zap.NewNop().Sugar())
+	<-dataManager.WarmedUp()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := dataManager.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if _, err := os.Stat(cacheCfg.SnapshotPath); err != nil {
+		t.Fatalf("snapshot is not written on shutdown: %v", err)
+	}
+}
+
+func TestDataManagerRejectsQueriesAfterShutdown(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := NewDataManagerWithStore(store, &config.CacheConfig{ClearInterval: time.Hour, CacheLimit: 10},
+		&config.RetryConfig{MaxAttempts: 1}, zap.NewNop().Sugar())
+
+	if err := dataManager.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	// Повторная остановка ничего не ждёт и возвращает результат первой
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dataManager.Shutdown(ctx); err != nil {
+		t.Fatalf("repeated shutdown: %v", err)
+	}
+	if _, err := dataManager.Get(context.Background(), "any"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	// Сообщение не должно считаться обработанным: его перечитает другой экземпляр сервиса
+	if err := dataManager.processMessage(context.Background(), newTestMessage(testutil.OrderJSON("late", testutil.DateCreated))); err == nil {
+		t.Fatalf("expected error after shutdown")
+	}
+}
+
+func TestDataManagerIsNotReadyDuringShutdown(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := NewDataManagerWithStore(store, &config.CacheConfig{ClearInterval: time.Hour, CacheLimit: 10},
+		&config.RetryConfig{MaxAttempts: 1}, zap.NewNop().Sugar())
+	<-dataManager.WarmedUp()
+
+	readiness := make(map[string]bool)
+	for _, component := range dataManager.Readiness(context.Background()) {
+		readiness[component.Name] = component.Ready
+	}
+	// Получатель не подключён, остальные компоненты готовы
+	if readiness["consumer"] || !readiness["postgres"] || !readiness["cache"] || !readiness["data_manager"] {
+		t.Fatalf("unexpected readiness: %v", readiness)
+	}
+
+	if err := dataManager.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	for _, component := range dataManager.Readiness(context.Background()) {
+		if component.Name == "data_manager" && component.Ready {
+			t.Fatalf("data manager is ready after shutdown")
+		}
+	}
+	if err := dataManager.AttachConsumer(&memory.Consumer{}, nil); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown on attach after shutdown, got %v", err)
+	}
+}
+
+func TestProcessMessageCommitsPoisonMessageWithoutDeadLetter(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := newTestDataManager(t, store)
+
+	if err := dataManager.processMessage(context.Background(), newTestMessage([]byte("not an order"))); err != nil {
+		t.Fatalf("invalid message must be committed, got %v", err)
+	}
+
+	changed := testutil.OrderJSON("conflicting", testutil.DateCreated)
+	if err := dataManager.processMessage(context.Background(), newTestMessage(changed)); err != nil {
+		t.Fatalf("process message: %v", err)
+	}
+	changed = []byte(strings.Replace(string(changed), `"locale": "en"`, `"locale": "ru"`, 1))
+	if err := dataManager.processMessage(context.Background(), newTestMessage(changed)); err != nil {
+		t.Fatalf("conflicting message must be committed, got %v", err)
+	}
+}
+
+// Получатель, подключение которого к брокеру висит, пока не закрыт dialed. started закрывается, когда
+// подключение началось
+type slowConsumer struct {
+	started chan struct{}
+	dialed  chan struct{}
+	closed  chan struct{}
+}
+
+func (c *slowConsumer) InitializeConsumer(process consumer.MessageProcessor) error {
+	close(c.started)
+	<-c.dialed
+	return nil
+}
+
+func (c *slowConsumer) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestDataManagerShutdownDoesNotWaitForConsumerDial(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	dataManager := NewDataManagerWithStore(store, &config.CacheConfig{ClearInterval: time.Hour, CacheLimit: 10},
+		&config.RetryConfig{MaxAttempts: 1}, zap.NewNop().Sugar())
+	<-dataManager.WarmedUp()
+
+	slow := &slowConsumer{started: make(chan struct{}), dialed: make(chan struct{}), closed: make(chan struct{})}
+	attached := make(chan error, 1)
+	go func() { attached <- dataManager.AttachConsumer(slow, nil) }()
+	<-slow.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dataManager.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	// Подключение, закончившееся после начала остановки, сразу закрывается
+	close(slow.dialed)
+	if err := <-attached; !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	select {
+	case <-slow.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("consumer attached during shutdown is not closed")
+	}
+}
@@ -1,67 +1,168 @@
 package consumer
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/IBM/sarama"
 	"github.com/nehachuha1/wbtech-tasks/internal/config"
 	"go.uber.org/zap"
+	"sync"
+	"time"
 )
 
-// Управляющая структура для работы с получателем сообщений в кафке.
+// Функция обработки сообщения из очереди. Если она вернула ошибку, то сообщение не помечается обработанным,
+// и его offset не коммитится. Контекст отменяется, когда сессия consumer group завершается
+type MessageProcessor func(ctx context.Context, message *sarama.ConsumerMessage) error
+
+// Управляющая структура для работы с получателем сообщений в кафке. Получатель работает в составе consumer group,
+// поэтому несколько экземпляров сервиса делят между собой партиции топика и продолжают чтение с закоммиченного offset
 type KafkaConsumer struct {
-	BrokerURL []string
-	Topic     string
-	Logger    *zap.SugaredLogger
-	Quit      chan bool
+	BrokerURL      []string
+	Topic          string
+	GroupID        string
+	RetryInterval  time.Duration
+	MessageTimeout time.Duration
+	Logger         *zap.SugaredLogger
+
+	group       sarama.ConsumerGroup
+	cancel      context.CancelFunc
+	consumeDone chan struct{}
+	closeOnce   sync.Once
+	closeErr    error
 }
 
 // Инициализация управляющей структуры
 func NewKafkaConsumer(kafkaConfig *config.KafkaConfig, logger *zap.SugaredLogger) *KafkaConsumer {
 	kafkaManager := &KafkaConsumer{
-		BrokerURL: []string{kafkaConfig.KafkaURL},
-		Topic:     kafkaConfig.Topic,
-		Logger:    logger,
+		BrokerURL:      []string{kafkaConfig.KafkaURL},
+		Topic:          kafkaConfig.Topic,
+		GroupID:        kafkaConfig.GroupID,
+		RetryInterval:  kafkaConfig.RetryInterval,
+		MessageTimeout: kafkaConfig.MessageTimeout,
+		Logger:         logger,
 	}
 
 	return kafkaManager
 }
 
-// Подключение нового получателя к брокеру очередей.
-func (km *KafkaConsumer) connectConsumer() (sarama.Consumer, error) {
+// Подключение новой consumer group к брокеру очередей. Если у группы ещё нет закоммиченных offset'ов, то читаем
+// топик с самого начала, чтобы не потерять сообщения, отправленные до первого запуска сервиса.
+// Автокоммит коммитит только те offset'ы, которые были помечены через MarkMessage
+func (km *KafkaConsumer) connectConsumer() (sarama.ConsumerGroup, error) {
 	cfg := sarama.NewConfig()
 	cfg.Consumer.Return.Errors = true
+	cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+	cfg.Consumer.Offsets.AutoCommit.Enable = true
+	cfg.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRange()}
 
-	return sarama.NewConsumer(km.BrokerURL, cfg)
+	return sarama.NewConsumerGroup(km.BrokerURL, km.GroupID, cfg)
 }
 
-// Инициализация получателя для партиции топика. Далее в горутине "слушаем" сигнал на канал выхода quit, если ловим его,
-// то закрываем подключение
-func (km *KafkaConsumer) InitializeConsumer(quit chan bool) (sarama.PartitionConsumer, error) {
-	worker, err := km.connectConsumer()
+// Инициализация получателя для всех партиций топика. В горутине крутится цикл Consume: он завершается при каждой
+// ребалансировке группы, после чего мы заново подключаемся к группе. Получатель работает, пока его
+// не остановят через Close
+func (km *KafkaConsumer) InitializeConsumer(process MessageProcessor) error {
+	group, err := km.connectConsumer()
 	if err != nil {
-		km.Logger.Warn(fmt.Sprintf("failed on consumer connection: %v", err))
-		return nil, err
+		km.Logger.Warnw("failed on consumer group connection", "group", km.GroupID, "error", err)
+		return err
 	}
-	consumer, err := worker.ConsumePartition(km.Topic, 0, sarama.OffsetNewest)
-	if err != nil {
-		km.Logger.Warn(fmt.Sprintf("failed on consume partition in topic %v: %v", km.Topic, err))
-		return nil, err
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &groupHandler{
+		processor: &RetryingProcessor{
+			Process:        process,
+			RetryInterval:  km.RetryInterval,
+			MessageTimeout: km.MessageTimeout,
+			Logger:         km.Logger,
+		},
+		logger: km.Logger,
 	}
+	km.group = group
+	km.cancel = cancel
+	km.consumeDone = make(chan struct{})
 
-	km.Logger.Info(fmt.Sprintf("consumer for topic %v started", km.Topic))
+	km.Logger.Infow("consumer group started", "group", km.GroupID, "topic", km.Topic)
 	go func() {
+		defer close(km.consumeDone)
 		for {
-			select {
-			case <-quit:
-				if err = worker.Close(); err != nil {
-					km.Logger.Warn(fmt.Sprintf("failed on closing consumer connection: %v", err))
+			err := group.Consume(ctx, []string{km.Topic}, handler)
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				km.Logger.Warnw("failed on consuming topic", "topic", km.Topic, "error", err)
+				select {
+				case <-time.After(km.RetryInterval):
+				case <-ctx.Done():
 					return
 				}
-				km.Logger.Info(fmt.Sprintf("successfully closed consumer of topic %v", km.Topic))
-				return
 			}
 		}
 	}()
 
-	return consumer, nil
+	go func() {
+		for err := range group.Errors() {
+			km.Logger.Warnw("consumer group error", "group", km.GroupID, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Остановка получателя. Сначала завершаем текущую сессию и дожидаемся, пока обрабатываемые сообщения
+// будут обработаны, а помеченные offset'ы закоммичены, после чего закрываем подключение к группе.
+// Повторные вызовы возвращают результат первого
+func (km *KafkaConsumer) Close() error {
+	km.closeOnce.Do(func() {
+		if km.group == nil {
+			return
+		}
+		km.cancel()
+		<-km.consumeDone
+		if km.closeErr = km.group.Close(); km.closeErr != nil {
+			km.Logger.Warnw("failed on closing consumer group connection", "group", km.GroupID, "error", km.closeErr)
+			return
+		}
+		km.Logger.Infow("successfully closed consumer group", "group", km.GroupID, "topic", km.Topic)
+	})
+	return km.closeErr
+}
+
+// Обработчик сессии consumer group. Сессия живёт от одной ребалансировки до другой
+type groupHandler struct {
+	processor *RetryingProcessor
+	logger    *zap.SugaredLogger
+}
+
+func (h *groupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	h.logger.Infow("consumer group session started", "claims", session.Claims())
+	return nil
+}
+
+func (h *groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	h.logger.Infow("consumer group session finished", "claims", session.Claims())
+	return nil
+}
+
+// Чтение сообщений партиции. Сообщение помечается обработанным только после успешной обработки, поэтому
+// при ошибке мы не идём дальше по партиции, а повторяем обработку этого же сообщения.
+// Отставание группы по партиции считается от high water mark партиции и удаляется, когда партицию забирают
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	lag := NewPartitionLag(claim.Topic(), claim.Partition(), claim.HighWaterMarkOffset)
+	defer lag.Delete()
+	for {
+		select {
+		case message, isOpen := <-claim.Messages():
+			if !isOpen {
+				return nil
+			}
+			if !h.processor.ProcessUntilSuccess(session.Context(), message, lag) {
+				return nil
+			}
+			session.MarkMessage(message, "")
+		case <-session.Context().Done():
+			return nil
+		}
+	}
 }
@@ -0,0 +1,9 @@
+package consumer
+
+// Интерфейс получателя сообщений из очереди: KafkaConsumer или получатель встроенного брокера (пакет kafka/memory).
+// Сообщения партиции передаются в process по порядку, сообщение считается обработанным, только когда process
+// вернул nil. Получатель работает до вызова Close, который дожидается обработки текущих сообщений
+type MessageConsumer interface {
+	InitializeConsumer(process MessageProcessor) error
+	Close() error
+}
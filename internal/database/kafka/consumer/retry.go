@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"context"
+	"github.com/IBM/sarama"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// Обработка сообщений партиции с повторами, общая для KafkaConsumer и получателя встроенного брокера.
+// Сообщение повторно обрабатывается через RetryInterval, пока обработка не станет успешной,
+// каждая попытка ограничена MessageTimeout
+type RetryingProcessor struct {
+	Process        MessageProcessor
+	RetryInterval  time.Duration
+	MessageTimeout time.Duration
+	Logger         *zap.SugaredLogger
+}
+
+// Повторяем обработку сообщения, пока она не станет успешной или пока не отменят ctx (например, партицию забрал
+// другой экземпляр сервиса - тогда он прочитает сообщение с последнего закоммиченного offset).
+// Отставание группы обновляется перед каждой попыткой, так что оно растёт, пока сообщение не получается обработать.
+// Возвращает false, если сообщение так и не обработано
+func (p *RetryingProcessor) ProcessUntilSuccess(ctx context.Context, message *sarama.ConsumerMessage,
+	lag *PartitionLag) bool {
+	for {
+		lag.Pending(message.Offset)
+		err := p.processWithTimeout(ctx, message)
+		if err == nil {
+			metrics.KafkaMessagesConsumed.WithLabelValues(message.Topic).Inc()
+			lag.Processed(message.Offset)
+			return true
+		}
+		metrics.KafkaMessagesFailed.WithLabelValues(message.Topic).Inc()
+		p.Logger.Warnw("failed on processing message", "topic", message.Topic, "partition", message.Partition,
+			"offset", message.Offset, "error", err)
+		select {
+		case <-time.After(p.RetryInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Одна попытка обработки сообщения. Её контекст отменяется по истечении MessageTimeout или вместе с ctx,
+// так что зависший запрос в базу не держит горутину партиции
+func (p *RetryingProcessor) processWithTimeout(ctx context.Context, message *sarama.ConsumerMessage) error {
+	if p.MessageTimeout <= 0 {
+		return p.Process(ctx, message)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.MessageTimeout)
+	defer cancel()
+	return p.Process(ctx, message)
+}
+
+// Отставание consumer group в партиции: сколько сообщений партиции ещё не обработано. highWaterMark - offset,
+// который получит следующее сообщение партиции
+type PartitionLag struct {
+	topic         string
+	partition     string
+	highWaterMark func() int64
+}
+
+func NewPartitionLag(topic string, partition int32, highWaterMark func() int64) *PartitionLag {
+	return &PartitionLag{topic: topic, partition: strconv.Itoa(int(partition)), highWaterMark: highWaterMark}
+}
+
+// Сообщение с offset ещё обрабатывается
+func (l *PartitionLag) Pending(offset int64) {
+	l.set(l.highWaterMark() - offset)
+}
+
+// Сообщение с offset обработано
+func (l *PartitionLag) Processed(offset int64) {
+	l.set(l.highWaterMark() - offset - 1)
+}
+
+// Удаление метрики, когда партицию забрали у получателя: её отставание теперь показывает другой экземпляр сервиса
+func (l *PartitionLag) Delete() {
+	metrics.KafkaConsumerLag.DeleteLabelValues(l.topic, l.partition)
+}
+
+func (l *PartitionLag) set(lag int64) {
+	metrics.KafkaConsumerLag.WithLabelValues(l.topic, l.partition).Set(float64(max(lag, 0)))
+}
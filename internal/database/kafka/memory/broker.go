@@ -0,0 +1,272 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/IBM/sarama"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Встроенный брокер очередей для тестов без кафки. Повторяет то, на что полагается сервис:
+// - топик состоит из партиций, порядок сообщений внутри партиции сохраняется, у каждого сообщения свой offset;
+// - сообщения с ключом попадают в партицию по хэшу ключа, без ключа - по кругу;
+// - получатели одной consumer group делят партиции топика между собой, при входе и выходе получателя партиции
+// перераспределяются (ребалансировка);
+// - offset коммитится только после успешной обработки, поэтому необработанное сообщение будет доставлено повторно
+// (тому же получателю или тому, кому партиция достанется после ребалансировки).
+// Partitions - число партиций у новых топиков (по умолчанию 1)
+type Broker struct {
+	Partitions int
+
+	mu          sync.Mutex
+	topics      map[string]*topic
+	groups      map[string]*group
+	changed     chan struct{}
+	unavailable bool
+}
+
+type topic struct {
+	partitions [][]*sarama.ConsumerMessage
+	next       int
+}
+
+// Consumer group: закоммиченные offset'ы по партициям и текущие участники. Поколение (generation) меняется
+// при каждой ребалансировке. Через leases партиция достаётся новому владельцу только после того, как
+// предыдущий владелец закончил с ней работу
+type group struct {
+	topic      string
+	offsets    map[int32]int64
+	members    []*Consumer
+	generation int
+	leases     map[int32]chan struct{}
+}
+
+// Инициализация пустого брокера
+func NewBroker(partitions int) *Broker {
+	if partitions <= 0 {
+		partitions = 1
+	}
+	return &Broker{
+		Partitions: partitions,
+		topics:     make(map[string]*topic),
+		groups:     make(map[string]*group),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Имитация недоступности брокера: пока она включена, отправка сообщений возвращает producer.ErrBrokerUnavailable
+func (b *Broker) SetUnavailable(unavailable bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unavailable = unavailable
+}
+
+// Запись сообщения в топик. Возвращает партицию и offset записанного сообщения
+func (b *Broker) Produce(msg *sarama.ProducerMessage) (int32, int64, error) {
+	var key, value []byte
+	var err error
+	if msg.Key != nil {
+		if key, err = msg.Key.Encode(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if msg.Value != nil {
+		if value, err = msg.Value.Encode(); err != nil {
+			return 0, 0, err
+		}
+	}
+	headers := make([]*sarama.RecordHeader, 0, len(msg.Headers))
+	for idx := range msg.Headers {
+		header := msg.Headers[idx]
+		headers = append(headers, &header)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.unavailable {
+		return 0, 0, &producer.SendError{Kind: producer.ErrBrokerUnavailable, Topic: msg.Topic,
+			Err: sarama.ErrOutOfBrokers}
+	}
+	t := b.topicLocked(msg.Topic)
+	partition := int32(t.next % len(t.partitions))
+	t.next++
+	if key != nil {
+		hash := fnv.New32a()
+		hash.Write(key)
+		partition = int32(hash.Sum32() % uint32(len(t.partitions)))
+	}
+
+	offset := int64(len(t.partitions[partition]))
+	t.partitions[partition] = append(t.partitions[partition], &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Partition: partition,
+		Offset:    offset,
+		Key:       key,
+		Value:     value,
+		Headers:   headers,
+		Timestamp: time.Now(),
+	})
+	b.notifyLocked()
+	return partition, offset, nil
+}
+
+// Все сообщения топика: по партициям, внутри партиции - по offset
+func (b *Broker) Messages(topicName string) []*sarama.ConsumerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []*sarama.ConsumerMessage
+	if t, isExists := b.topics[topicName]; isExists {
+		for _, partition := range t.partitions {
+			messages = append(messages, partition...)
+		}
+	}
+	return messages
+}
+
+// Закоммиченный offset группы в партиции - offset следующего сообщения, которое получит группа
+func (b *Broker) Committed(groupID string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if g, isExists := b.groups[groupID]; isExists {
+		return g.offsets[partition]
+	}
+	return 0
+}
+
+// Offset, который получит следующее записанное в партицию сообщение
+func (b *Broker) highWaterMark(topicName string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, isExists := b.topics[topicName]; isExists && int(partition) < len(t.partitions) {
+		return int64(len(t.partitions[partition]))
+	}
+	return 0
+}
+
+// Вход получателя в группу с ребалансировкой
+func (b *Broker) join(groupID string, topicName string, member *Consumer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, isExists := b.groups[groupID]
+	if !isExists {
+		g = &group{topic: topicName, offsets: make(map[int32]int64), leases: make(map[int32]chan struct{})}
+		b.groups[groupID] = g
+	}
+	if g.topic != topicName {
+		return errors.New("consumer group " + groupID + " already consumes topic " + g.topic)
+	}
+	b.topicLocked(topicName)
+	g.members = append(g.members, member)
+	g.generation++
+	b.notifyLocked()
+	return nil
+}
+
+// Выход получателя из группы с ребалансировкой
+func (b *Broker) leave(groupID string, member *Consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.groups[groupID]
+	for idx, candidate := range g.members {
+		if candidate == member {
+			g.members = append(g.members[:idx], g.members[idx+1:]...)
+			break
+		}
+	}
+	g.generation++
+	b.notifyLocked()
+}
+
+// Поколение группы и назначенные в нём получателю партиции (по кругу в порядке входа в группу)
+func (b *Broker) assignment(groupID string, member *Consumer) (int, []int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.groups[groupID]
+	t := b.topics[g.topic]
+	var partitions []int32
+	for idx, candidate := range g.members {
+		if candidate != member {
+			continue
+		}
+		for partition := idx; partition < len(t.partitions); partition += len(g.members) {
+			partitions = append(partitions, int32(partition))
+		}
+	}
+	return g.generation, partitions
+}
+
+// Текущее поколение группы и канал, который закроется при следующем изменении в брокере
+func (b *Broker) watch(groupID string) (int, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.groups[groupID].generation, b.changed
+}
+
+// Захват партиции группы. Ждём, пока предыдущий владелец её отпустит, или пока не истечёт ctx
+func (b *Broker) acquire(ctx context.Context, groupID string, partition int32) (func(), error) {
+	b.mu.Lock()
+	g := b.groups[groupID]
+	lease, isExists := g.leases[partition]
+	if !isExists {
+		lease = make(chan struct{}, 1)
+		g.leases[partition] = lease
+	}
+	b.mu.Unlock()
+
+	select {
+	case lease <- struct{}{}:
+		return func() { <-lease }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Следующее сообщение партиции для группы - сообщение по закоммиченному offset'у. Если его ещё нет,
+// то ждём записи в топик или истечения ctx
+func (b *Broker) next(ctx context.Context, groupID string, partition int32) (*sarama.ConsumerMessage, error) {
+	for {
+		b.mu.Lock()
+		g := b.groups[groupID]
+		messages := b.topics[g.topic].partitions[partition]
+		offset := g.offsets[partition]
+		changed := b.changed
+		b.mu.Unlock()
+		if offset < int64(len(messages)) {
+			return messages[offset], nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Коммит offset'а группы в партиции
+func (b *Broker) commit(groupID string, partition int32, offset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.groups[groupID]
+	if offset > g.offsets[partition] {
+		g.offsets[partition] = offset
+	}
+}
+
+func (b *Broker) topicLocked(topicName string) *topic {
+	t, isExists := b.topics[topicName]
+	if !isExists {
+		t = &topic{partitions: make([][]*sarama.ConsumerMessage, b.Partitions)}
+		b.topics[topicName] = t
+	}
+	return t
+}
+
+// Оповещение ждущих получателей: закрываем текущий канал изменений и заводим новый
+func (b *Broker) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,237 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IBM/sarama"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConsumer(broker *Broker) *Consumer {
+	return NewConsumer(broker, &config.KafkaConfig{
+		Topic:         "orders",
+		GroupID:       "orders-group",
+		RetryInterval: time.Millisecond,
+	}, zap.NewNop().Sugar())
+}
+
+func produce(t *testing.T, broker *Broker, key string, value string) {
+	t.Helper()
+	msg := &sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder(value)}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	if _, _, err := broker.Produce(msg); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+}
+
+// Сборщик обработанных сообщений с ожиданием нужного количества
+type collector struct {
+	mu       sync.Mutex
+	values   map[int32][]string
+	received chan struct{}
+}
+
+func newCollector() *collector {
+	return &collector{values: make(map[int32][]string), received: make(chan struct{}, 1000)}
+}
+
+func (c *collector) process(ctx context.Context, message *sarama.ConsumerMessage) error {
+	c.mu.Lock()
+	c.values[message.Partition] = append(c.values[message.Partition], string(message.Value))
+	c.mu.Unlock()
+	c.received <- struct{}{}
+	return nil
+}
+
+func (c *collector) wait(t *testing.T, count int) {
+	t.Helper()
+	for idx := 0; idx < count; idx++ {
+		select {
+		case <-c.received:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("received only %v of %v messages", idx, count)
+		}
+	}
+}
+
+func TestBrokerKeepsOrderWithinPartition(t *testing.T) {
+	broker := NewBroker(3)
+	for idx := 0; idx < 30; idx++ {
+		produce(t, broker, fmt.Sprintf("key-%v", idx%5), strconv.Itoa(idx))
+	}
+
+	lastByKey := make(map[string]int)
+	partitionByKey := make(map[string]int32)
+	for _, message := range broker.Messages("orders") {
+		key := string(message.Key)
+		idx, _ := strconv.Atoi(string(message.Value))
+		if partition, isSeen := partitionByKey[key]; isSeen && partition != message.Partition {
+			t.Fatalf("messages with key %v are in partitions %v and %v", key, partition, message.Partition)
+		}
+		partitionByKey[key] = message.Partition
+		if last, isSeen := lastByKey[key]; isSeen && last > idx {
+			t.Fatalf("messages with key %v are out of order", key)
+		}
+		lastByKey[key] = idx
+	}
+}
+
+func TestConsumerGroupDeliversEachMessageOnce(t *testing.T) {
+	broker := NewBroker(4)
+	received := newCollector()
+
+	first, second := newTestConsumer(broker), newTestConsumer(broker)
+	for _, member := range []*Consumer{first, second} {
+		if err := member.InitializeConsumer(received.process); err != nil {
+			t.Fatalf("initialize consumer: %v", err)
+		}
+		defer member.Close()
+	}
+	for idx := 0; idx < 40; idx++ {
+		produce(t, broker, "", fmt.Sprint(idx))
+	}
+	received.wait(t, 40)
+
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	total := 0
+	for partition, values := range received.values {
+		total += len(values)
+		if len(values) != 10 {
+			t.Fatalf("partition %v delivered %v messages instead of 10", partition, len(values))
+		}
+	}
+	if total != 40 {
+		t.Fatalf("expected each message once, got %v deliveries", total)
+	}
+}
+
+func TestConsumerRedeliversFailedMessages(t *testing.T) {
+	broker := NewBroker(1)
+	var mu sync.Mutex
+	var attempts []string
+	done := make(chan struct{})
+	process := func(ctx context.Context, message *sarama.ConsumerMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, string(message.Value))
+		if len(attempts) < 3 {
+			return errors.New("postgres is unavailable")
+		}
+		if string(message.Value) == "second" {
+			close(done)
+		}
+		return nil
+	}
+
+	member := newTestConsumer(broker)
+	if err := member.InitializeConsumer(process); err != nil {
+		t.Fatalf("initialize consumer: %v", err)
+	}
+	defer member.Close()
+	produce(t, broker, "", "first")
+	produce(t, broker, "", "second")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("messages are not processed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(attempts) != "[first first first second]" {
+		t.Fatalf("unexpected delivery order: %v", attempts)
+	}
+}
+
+func TestConsumerGroupResumesFromCommittedOffset(t *testing.T) {
+	broker := NewBroker(2)
+	received := newCollector()
+
+	first := newTestConsumer(broker)
+	if err := first.InitializeConsumer(received.process); err != nil {
+		t.Fatalf("initialize consumer: %v", err)
+	}
+	for idx := 0; idx < 10; idx++ {
+		produce(t, broker, "", fmt.Sprint(idx))
+	}
+	received.wait(t, 10)
+	first.Close()
+	if committed := broker.Committed("orders-group", 0) + broker.Committed("orders-group", 1); committed != 10 {
+		t.Fatalf("expected 10 committed messages, got %v", committed)
+	}
+
+	for idx := 10; idx < 14; idx++ {
+		produce(t, broker, "", fmt.Sprint(idx))
+	}
+	second := newTestConsumer(broker)
+	if err := second.InitializeConsumer(received.process); err != nil {
+		t.Fatalf("initialize consumer: %v", err)
+	}
+	defer second.Close()
+	received.wait(t, 4)
+
+	select {
+	case <-received.received:
+		t.Fatalf("committed message was delivered again")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestProducerReportsUnavailableBroker(t *testing.T) {
+	broker := NewBroker(1)
+	orders := NewProducer(broker, &config.KafkaConfig{Topic: "orders"}, zap.NewNop().Sugar())
+
+	broker.SetUnavailable(true)
+	err := orders.PushOrderToQueue(context.Background(), []byte("{}"))
+	if !errors.Is(err, producer.ErrBrokerUnavailable) || !producer.IsTransientError(err) {
+		t.Fatalf("expected transient ErrBrokerUnavailable, got %v", err)
+	}
+	broker.SetUnavailable(false)
+	if err = orders.PushOrderToQueue(context.Background(), []byte("{}")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if messages := broker.Messages("orders"); len(messages) != 1 {
+		t.Fatalf("expected one message in topic, got %v", len(messages))
+	}
+}
+
+func TestConsumerLagGrowsWhileMessageIsStuck(t *testing.T) {
+	broker := NewBroker(1)
+	process := func(ctx context.Context, message *sarama.ConsumerMessage) error {
+		return errors.New("postgres is unavailable")
+	}
+	member := newTestConsumer(broker)
+	if err := member.InitializeConsumer(process); err != nil {
+		t.Fatalf("initialize consumer: %v", err)
+	}
+	for idx := 0; idx < 3; idx++ {
+		produce(t, broker, "", fmt.Sprint(idx))
+	}
+
+	lag := metrics.KafkaConsumerLag.WithLabelValues("orders", "0")
+	deadline := time.Now().Add(time.Second * 5)
+	for testutil.ToFloat64(lag) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected lag 3 while first message is stuck, got %v", testutil.ToFloat64(lag))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Партицию забрали у получателя - его метрика отставания удаляется
+	member.Close()
+	if count := testutil.CollectAndCount(metrics.KafkaConsumerLag); count != 0 {
+		t.Fatalf("expected lag series to be deleted after close, got %v series", count)
+	}
+}
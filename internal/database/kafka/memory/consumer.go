@@ -0,0 +1,131 @@
+package memory
+
+import (
+	"context"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/consumer"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Получатель сообщений встроенного брокера, реализует consumer.MessageConsumer. Ведёт себя так же, как
+// KafkaConsumer: сообщение партиции повторно обрабатывается через RetryInterval, пока обработка не станет успешной,
+// каждая попытка ограничена MessageTimeout, offset коммитится только после успешной обработки
+type Consumer struct {
+	Broker         *Broker
+	Topic          string
+	GroupID        string
+	RetryInterval  time.Duration
+	MessageTimeout time.Duration
+	Logger         *zap.SugaredLogger
+
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Инициализация получателя с теми же настройками из конфига кафки, что и у KafkaConsumer
+func NewConsumer(broker *Broker, kafkaConfig *config.KafkaConfig, logger *zap.SugaredLogger) *Consumer {
+	return &Consumer{
+		Broker:         broker,
+		Topic:          kafkaConfig.Topic,
+		GroupID:        kafkaConfig.GroupID,
+		RetryInterval:  kafkaConfig.RetryInterval,
+		MessageTimeout: kafkaConfig.MessageTimeout,
+		Logger:         logger,
+	}
+}
+
+// Вход в consumer group и запуск чтения назначенных партиций. Получатель работает до вызова Close
+func (c *Consumer) InitializeConsumer(process consumer.MessageProcessor) error {
+	if err := c.Broker.join(c.GroupID, c.Topic, c); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.Logger.Infow("in-memory consumer group started", "group", c.GroupID, "topic", c.Topic)
+
+	go c.run(ctx, process)
+	return nil
+}
+
+// Остановка получателя: дожидаемся обработки текущих сообщений и выходим из группы, после чего партиции
+// получателя достаются остальным участникам группы
+func (c *Consumer) Close() error {
+	c.closeOnce.Do(func() {
+		if c.cancel == nil {
+			return
+		}
+		c.cancel()
+		<-c.done
+		c.Broker.leave(c.GroupID, c)
+		c.Logger.Infow("in-memory consumer group stopped", "group", c.GroupID, "topic", c.Topic)
+	})
+	return nil
+}
+
+// Цикл сессий: на каждое поколение группы читаем назначенные партиции, при ребалансировке завершаем
+// чтение и начинаем новую сессию
+func (c *Consumer) run(ctx context.Context, process consumer.MessageProcessor) {
+	defer close(c.done)
+	for {
+		generation, partitions := c.Broker.assignment(c.GroupID, c)
+		sessionCtx, cancelSession := context.WithCancel(ctx)
+		var session sync.WaitGroup
+		for _, partition := range partitions {
+			session.Add(1)
+			go func() {
+				defer session.Done()
+				c.consumePartition(sessionCtx, partition, process)
+			}()
+		}
+
+		for {
+			current, changed := c.Broker.watch(c.GroupID)
+			if current != generation {
+				break
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				cancelSession()
+				session.Wait()
+				return
+			}
+		}
+		cancelSession()
+		session.Wait()
+	}
+}
+
+// Чтение партиции с закоммиченного offset'а, пока сессия не завершится. Метрики те же, что и у KafkaConsumer
+func (c *Consumer) consumePartition(ctx context.Context, partition int32, process consumer.MessageProcessor) {
+	release, err := c.Broker.acquire(ctx, c.GroupID, partition)
+	if err != nil {
+		return
+	}
+	defer release()
+	processor := &consumer.RetryingProcessor{
+		Process:        process,
+		RetryInterval:  c.RetryInterval,
+		MessageTimeout: c.MessageTimeout,
+		Logger:         c.Logger,
+	}
+	lag := consumer.NewPartitionLag(c.Topic, partition, func() int64 {
+		return c.Broker.highWaterMark(c.Topic, partition)
+	})
+	defer lag.Delete()
+
+	for {
+		message, err := c.Broker.next(ctx, c.GroupID, partition)
+		if err != nil {
+			return
+		}
+		if !processor.ProcessUntilSuccess(ctx, message, lag) {
+			return
+		}
+		c.Broker.commit(c.GroupID, partition, message.Offset+1)
+	}
+}
@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/IBM/sarama"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Продюсер встроенного брокера, реализует producer.OrderProducer и producer.DeadLetterProducer.
+// Сообщения сразу записываются в брокер, ошибки отправки - те же SendError, что и у KafkaProducer.
+// Outbox нет: DeferToOutbox всегда возвращает ошибку
+type Producer struct {
+	Broker          *Broker
+	Topic           string
+	DeadLetterTopic string
+	Logger          *zap.SugaredLogger
+
+	mu       sync.RWMutex
+	isClosed bool
+}
+
+// Инициализация продюсера с топиками из конфига кафки
+func NewProducer(broker *Broker, kafkaConfig *config.KafkaConfig, logger *zap.SugaredLogger) *Producer {
+	return &Producer{
+		Broker:          broker,
+		Topic:           kafkaConfig.Topic,
+		DeadLetterTopic: kafkaConfig.DeadLetterTopic,
+		Logger:          logger,
+	}
+}
+
+// Отправка заказа в топик. Correlation ID из ctx передаётся в заголовке, как и у KafkaProducer
+func (p *Producer) PushOrderToQueue(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		sendErr := &producer.SendError{Topic: p.Topic, Err: err}
+		if errors.Is(err, context.DeadlineExceeded) {
+			sendErr.Kind = producer.ErrTimeout
+		}
+		return sendErr
+	}
+	return p.send(ctx, &sarama.ProducerMessage{Topic: p.Topic, Value: sarama.ByteEncoder(data),
+		Headers: producer.CorrelationHeaders(ctx)})
+}
+
+func (p *Producer) DeferToOutbox(data []byte) error {
+	return errors.New("outbox is disabled")
+}
+
+// Отправка необработанного сообщения в dead-letter топик с теми же заголовками, что и у KafkaProducer
+func (p *Producer) PushToDeadLetter(message *sarama.ConsumerMessage, failure *handlers.QueryFailure,
+	attempts int) error {
+	ctx := log.WithCorrelationID(context.Background(), producer.CorrelationIDFromHeaders(message))
+	return p.send(ctx, producer.DeadLetterMessage(p.DeadLetterTopic, message, failure, attempts))
+}
+
+// После закрытия продюсер возвращает ошибку producer.ErrBrokerUnavailable, как и KafkaProducer
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.isClosed = true
+	return nil
+}
+
+func (p *Producer) send(ctx context.Context, msg *sarama.ProducerMessage) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.isClosed {
+		return &producer.SendError{Kind: producer.ErrBrokerUnavailable, Topic: msg.Topic, Err: producer.ErrProducerClosed}
+	}
+	start := time.Now()
+	partition, offset, err := p.Broker.Produce(msg)
+	metrics.KafkaProducerSendDuration.WithLabelValues(msg.Topic, metrics.Result(err)).Observe(metrics.Since(start))
+	if err != nil {
+		log.FromContext(ctx, p.Logger).Warnw("failed to send message", "topic", msg.Topic, "error", err)
+		return err
+	}
+	log.FromContext(ctx, p.Logger).Infow("sent message", "topic", msg.Topic, "partition", partition,
+		"offset", offset)
+	return nil
+}
@@ -0,0 +1,84 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IBM/sarama"
+	"net"
+	"strings"
+)
+
+// Типы ошибок отправки сообщений. Проверяются через errors.Is и используются в обработчиках для выбора HTTP-статуса
+var (
+	ErrBrokerUnavailable = errors.New("kafka broker is unavailable")
+	ErrMessageTooLarge   = errors.New("message is too large for kafka")
+	ErrTimeout           = errors.New("timed out while sending message to kafka")
+)
+
+// Ошибка отправки сообщения в топик. Kind - один из типов ошибок выше (nil, если ошибку не удалось
+// классифицировать), Err - исходная ошибка sarama
+type SendError struct {
+	Kind  error
+	Topic string
+	Err   error
+}
+
+func (e *SendError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("failed to send message to topic %v: %v: %v", e.Topic, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("failed to send message to topic %v: %v", e.Topic, e.Err)
+}
+
+func (e *SendError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Проверка, что ошибка отправки временная: брокер недоступен, лидер партиции переизбирается, истёк таймаут
+func IsTransientError(err error) bool {
+	return errors.Is(err, ErrBrokerUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// Оборачивание ошибки sarama в SendError с определением её типа
+func classifyError(topic string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var sendErr *SendError
+	if errors.As(err, &sendErr) {
+		return err
+	}
+	return &SendError{Kind: errorKind(err), Topic: topic, Err: err}
+}
+
+func errorKind(err error) error {
+	var configErr sarama.ConfigurationError
+	if errors.Is(err, sarama.ErrMessageSizeTooLarge) || errors.Is(err, sarama.ErrMessageTooLarge) ||
+		(errors.As(err, &configErr) && strings.Contains(string(configErr), "MaxMessageBytes")) {
+		return ErrMessageTooLarge
+	}
+
+	var netErr net.Error
+	if errors.Is(err, sarama.ErrRequestTimedOut) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrTimeout
+	}
+
+	for _, unavailableErr := range []error{sarama.ErrOutOfBrokers, sarama.ErrNotConnected, sarama.ErrShuttingDown,
+		sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition, sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend, sarama.ErrNetworkException, sarama.ErrBrokerNotAvailable,
+		ErrProducerClosed} {
+		if errors.Is(err, unavailableErr) {
+			return ErrBrokerUnavailable
+		}
+	}
+	if errors.As(err, &netErr) {
+		return ErrBrokerUnavailable
+	}
+	return nil
+}
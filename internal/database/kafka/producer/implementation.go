@@ -0,0 +1,20 @@
+package producer
+
+import (
+	"context"
+	"github.com/IBM/sarama"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+)
+
+// Интерфейс отправителя заказов в очередь: KafkaProducer или продюсер встроенного брокера (пакет kafka/memory)
+type OrderProducer interface {
+	PushOrderToQueue(ctx context.Context, data []byte) error
+	DeferToOutbox(data []byte) error
+	Close() error
+}
+
+// Интерфейс отправителя необработанных сообщений в dead-letter топик
+type DeadLetterProducer interface {
+	PushToDeadLetter(message *sarama.ConsumerMessage, failure *handlers.QueryFailure, attempts int) error
+	Close() error
+}
@@ -0,0 +1,219 @@
+package producer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Ошибка Flush, если в outbox нашлись записи, которые не удалось разобрать (например, строка, оборванная
+// падением сервиса посреди Add). Такие записи переносятся в файл Path + ".corrupted", остальные отправляются
+var ErrCorruptedRecords = errors.New("corrupted records in outbox")
+
+// Локальный outbox для заказов, которые не удалось отправить в кафку. Сообщения дописываются в файл построчно
+// в формате JSON и отправляются повторно, когда брокер снова становится доступен.
+// mu защищает файл, flushMu не даёт запустить две отправки одновременно: сама отправка идёт без mu,
+// чтобы Add не ждал брокера
+type Outbox struct {
+	Path    string
+	mu      sync.Mutex
+	flushMu sync.Mutex
+}
+
+// Запись в outbox: топик и тело сообщения
+type outboxRecord struct {
+	Topic string `json:"topic"`
+	Value []byte `json:"value"`
+}
+
+// Инициализация outbox. Директория для файла создаётся, если её нет
+func NewOutbox(path string) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("can't create directory for outbox: %v", err)
+	}
+	return &Outbox{Path: path}, nil
+}
+
+// Добавление сообщения в outbox. Запись синхронизируется с диском, чтобы принятый заказ пережил падение сервиса.
+// Если прошлая запись оборвана, то начинаем с новой строки, чтобы не склеить с ней новую
+func (o *Outbox) Add(topic string, value []byte) error {
+	line, err := json.Marshal(&outboxRecord{Topic: topic, Value: value})
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	file, err := os.OpenFile(o.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	torn, err := endsWithoutNewline(file)
+	if err != nil {
+		return err
+	}
+	if torn {
+		line = append([]byte{'\n'}, line...)
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Отправка накопленных сообщений через send. Отправка останавливается на первой ошибке, неотправленные сообщения
+// остаются в outbox. Записи читаются и перезаписываются под блокировкой, а отправляются без неё; сообщения,
+// добавленные во время отправки, сохраняются. Битые записи переносятся в карантин, и возвращается
+// ErrCorruptedRecords. Возвращает количество отправленных сообщений
+func (o *Outbox) Flush(send func(topic string, value []byte) error) (int, error) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	o.mu.Lock()
+	lines, err := o.readLines()
+	o.mu.Unlock()
+	if err != nil || len(lines) == 0 {
+		return 0, err
+	}
+	records, corrupted := parseRecords(lines)
+
+	sent := 0
+	var sendErr error
+	for _, record := range records {
+		if sendErr = send(record.Topic, record.Value); sendErr != nil {
+			break
+		}
+		sent++
+	}
+	if sent == 0 && len(corrupted) == 0 {
+		return 0, sendErr
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current, err := o.readLines()
+	if err != nil {
+		return sent, err
+	}
+	// Add только дописывает в конец файла, поэтому всё, что после прочитанных строк, добавлено во время отправки
+	appended, appendedCorrupted := parseRecords(current[min(len(lines), len(current)):])
+	corrupted = append(corrupted, appendedCorrupted...)
+	if err = o.quarantine(corrupted); err != nil {
+		return sent, err
+	}
+	if err = o.rewrite(append(records[sent:], appended...)); err != nil {
+		return sent, err
+	}
+	if sendErr == nil && len(corrupted) > 0 {
+		sendErr = fmt.Errorf("%w: moved %v records to %v", ErrCorruptedRecords, len(corrupted), o.quarantinePath())
+	}
+	return sent, sendErr
+}
+
+func (o *Outbox) readLines() ([][]byte, error) {
+	file, err := os.Open(o.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([][]byte, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	return lines, scanner.Err()
+}
+
+// Разбор строк outbox на записи и строки, которые не удалось разобрать
+func parseRecords(lines [][]byte) ([]*outboxRecord, [][]byte) {
+	records := make([]*outboxRecord, 0, len(lines))
+	var corrupted [][]byte
+	for _, line := range lines {
+		record := &outboxRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			corrupted = append(corrupted, line)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, corrupted
+}
+
+func (o *Outbox) quarantinePath() string {
+	return o.Path + ".corrupted"
+}
+
+// Перенос битых записей в отдельный файл, чтобы их можно было разобрать вручную
+func (o *Outbox) quarantine(lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(o.quarantinePath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, line := range lines {
+		if _, err = file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// Проверка, что файл не пустой и не заканчивается переводом строки, то есть последняя запись оборвана
+func endsWithoutNewline(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err = file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+// Перезапись outbox оставшимися сообщениями. Пишем во временный файл и переименовываем его, чтобы при падении
+// посреди записи не потерять сообщения
+func (o *Outbox) rewrite(records []*outboxRecord) error {
+	if len(records) == 0 {
+		if err := os.Remove(o.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tempPath := o.Path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		writer.Write(append(line, '\n'))
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, o.Path)
+}
@@ -0,0 +1,99 @@
+package producer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestOutbox(t *testing.T) *Outbox {
+	outbox, err := NewOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbox
+}
+
+func flushValues(t *testing.T, outbox *Outbox) ([]string, error) {
+	var values []string
+	_, err := outbox.Flush(func(topic string, value []byte) error {
+		values = append(values, string(value))
+		return nil
+	})
+	return values, err
+}
+
+func TestOutboxQuarantinesTornRecord(t *testing.T) {
+	outbox := newTestOutbox(t)
+	if err := outbox.Add("orders", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// Запись, оборванная падением сервиса посреди Add
+	file, err := os.OpenFile(outbox.Path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"topic":"orders","val`)
+	file.Close()
+	if err = outbox.Add("orders", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := flushValues(t, outbox)
+	if !errors.Is(err, ErrCorruptedRecords) {
+		t.Fatalf("expected ErrCorruptedRecords, got %v", err)
+	}
+	if len(values) != 2 || values[0] != "first" || values[1] != "second" {
+		t.Fatalf("expected both valid records to be sent, got %v", values)
+	}
+	quarantined, err := os.ReadFile(outbox.quarantinePath())
+	if err != nil || string(quarantined) != "{\"topic\":\"orders\",\"val\n" {
+		t.Fatalf("expected torn record in quarantine, got %q (%v)", quarantined, err)
+	}
+
+	if values, err = flushValues(t, outbox); err != nil || len(values) != 0 {
+		t.Fatalf("expected empty outbox after flush, got %v (%v)", values, err)
+	}
+}
+
+func TestOutboxAddIsNotBlockedByFlush(t *testing.T) {
+	outbox := newTestOutbox(t)
+	if err := outbox.Add("orders", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	flushed := make(chan error)
+	go func() {
+		_, err := outbox.Flush(func(topic string, value []byte) error {
+			close(sending)
+			<-release
+			return nil
+		})
+		flushed <- err
+	}()
+
+	<-sending
+	added := make(chan error)
+	go func() { added <- outbox.Add("orders", []byte("second")) }()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Add is blocked by Flush")
+	}
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := flushValues(t, outbox)
+	if err != nil || len(values) != 1 || values[0] != "second" {
+		t.Fatalf("expected record added during flush to stay in outbox, got %v (%v)", values, err)
+	}
+}
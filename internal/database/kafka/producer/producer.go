@@ -1,60 +1,456 @@
 package producer
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/IBM/sarama"
 	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
 	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"time"
 )
 
-// Управляющая структура для работы с отправителем сообщений в кафке.
+// Заголовки сообщений в dead-letter топике. По ним можно понять, почему сообщение не удалось обработать,
+// и откуда оно пришло
+const (
+	HeaderFailureStage      = "x-failure-stage"
+	HeaderFailureCode       = "x-failure-code"
+	HeaderError             = "x-error"
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderAttempts          = "x-attempts"
+)
+
+// Заголовок с correlation ID запроса, в рамках которого заказ попал в очередь. По нему логи получателя
+// связываются с логами HTTP-запроса
+const HeaderCorrelationID = "x-correlation-id"
+
+// Ошибка отправки через уже закрытого продюсера
+var ErrProducerClosed = errors.New("kafka producer is closed")
+
+// Колбэк с результатом доставки сообщения в асинхронном режиме. err == nil, если сообщение доставлено в топик
+type DeliveryCallback func(msg *sarama.ProducerMessage, err error)
+
+// Управляющая структура для работы с отправителем сообщений в кафке. Подключение к брокеру создаётся один раз
+// и переиспользуется всеми запросами (продюсеры sarama безопасны для конкурентного использования).
+// В асинхронном режиме (Async) PushOrderToQueue не ждёт подтверждения от брокера: сообщения копятся в пачки
+// по FlushMessages штук или FlushFrequency времени, а результат доставки приходит в колбэк OnDelivery.
+// Если задан Outbox, то заказы, которые не удалось отправить из-за недоступности кафки, можно сохранить в него
 type KafkaProducer struct {
-	BrokerURL []string
-	Topic     string
-	Logger    *zap.SugaredLogger
-	Quit      chan bool
+	BrokerURL       []string
+	Topic           string
+	DeadLetterTopic string
+	Async           bool
+	FlushFrequency  time.Duration
+	FlushMessages   int
+	OnDelivery      DeliveryCallback
+	Outbox          *Outbox
+	Logger          *zap.SugaredLogger
+	Quit            chan bool
+
+	mu            sync.RWMutex
+	syncProducer  sarama.SyncProducer
+	asyncProducer sarama.AsyncProducer
+	deliveries    sync.WaitGroup
+	isClosed      bool
+	closed        chan struct{}
 }
 
-// Инициализация управляющей структуры
+// Инициализация управляющей структуры. Сразу пробуем подключиться к брокеру, но если он недоступен, то не падаем:
+// подключение повторится при первой отправке сообщения. В горутине по тикеру отправляем сообщения из outbox
+// и ждём сигнала на канал выхода Quit, по нему дожидаемся отправки накопленных сообщений и закрываем подключение
 func NewKafkaProducer(kafkaConfig *config.KafkaConfig, logger *zap.SugaredLogger) *KafkaProducer {
-	return &KafkaProducer{
-		BrokerURL: []string{kafkaConfig.KafkaURL},
-		Topic:     kafkaConfig.Topic,
-		Logger:    logger,
-		Quit:      make(chan bool),
+	kp := &KafkaProducer{
+		BrokerURL:       []string{kafkaConfig.KafkaURL},
+		Topic:           kafkaConfig.Topic,
+		DeadLetterTopic: kafkaConfig.DeadLetterTopic,
+		Async:           kafkaConfig.ProducerAsync,
+		FlushFrequency:  kafkaConfig.ProducerFlushFrequency,
+		FlushMessages:   kafkaConfig.ProducerFlushMessages,
+		Logger:          logger,
+		Quit:            make(chan bool),
+		closed:          make(chan struct{}),
+	}
+	kp.OnDelivery = kp.handleDelivery
+
+	var err error
+	if kp.Async {
+		err = kp.withAsyncProducer(func(sarama.AsyncProducer) error { return nil })
+	} else {
+		err = kp.withSyncProducer(func(sarama.SyncProducer) error { return nil })
+	}
+	if err != nil {
+		logger.Warnw("failed on initialize producer, will retry on first message", "topic", kp.Topic, "error", err)
+	} else {
+		logger.Infow("initialized producer", "topic", kp.Topic)
+	}
+
+	if kafkaConfig.OutboxPath != "" {
+		outbox, err := NewOutbox(kafkaConfig.OutboxPath)
+		if err != nil {
+			logger.Warnw("outbox is disabled", "error", err)
+		} else {
+			kp.Outbox = outbox
+		}
 	}
+	if kp.Async && kp.Outbox == nil {
+		logger.Warnw("async producer is running without outbox, orders failed on delivery will be lost",
+			"topic", kp.Topic)
+	}
+
+	go func() {
+		var outboxTicks <-chan time.Time
+		if kp.Outbox != nil {
+			ticker := time.NewTicker(kafkaConfig.OutboxFlushInterval)
+			defer ticker.Stop()
+			outboxTicks = ticker.C
+		}
+		for {
+			select {
+			case <-outboxTicks:
+				kp.flushOutbox()
+			case <-kp.Quit:
+				kp.Close()
+				return
+			case <-kp.closed:
+				return
+			}
+		}
+	}()
+	return kp
 }
 
-// Подключение нового продюсера к брокеру очередей.
-func (kp *KafkaProducer) connectProducer() (sarama.SyncProducer, error) {
+// Общий конфиг продюсера для синхронного и асинхронного режимов
+func (kp *KafkaProducer) producerConfig() *sarama.Config {
 	producerConfig := sarama.NewConfig()
 	producerConfig.Producer.Return.Successes = true
+	producerConfig.Producer.Return.Errors = true
 	producerConfig.Producer.RequiredAcks = sarama.WaitForLocal
 	producerConfig.Producer.Retry.Max = 5
+	return producerConfig
+}
 
-	return sarama.NewSyncProducer(kp.BrokerURL, producerConfig)
+// Подключение нового синхронного продюсера к брокеру очередей.
+func (kp *KafkaProducer) connectProducer() (sarama.SyncProducer, error) {
+	return sarama.NewSyncProducer(kp.BrokerURL, kp.producerConfig())
 }
 
-// Основной метод структуры для пуша сообщений в очередь. При вызове метода каждый раз инициализируем нового продюсера,
-// пушим сообщение в топик и закрываем текущего продюсера
-func (kp *KafkaProducer) PushOrderToQueue(data []byte) error {
-	producer, err := kp.connectProducer()
-	if err != nil {
-		kp.Logger.Fatal(fmt.Sprintf("failed on initialize producer to topic %v", kp.Topic))
-		return err
+// Подключение нового асинхронного продюсера к брокеру очередей. Сообщения отправляются пачками
+func (kp *KafkaProducer) connectAsyncProducer() (sarama.AsyncProducer, error) {
+	producerConfig := kp.producerConfig()
+	producerConfig.Producer.Flush.Frequency = kp.FlushFrequency
+	producerConfig.Producer.Flush.Messages = kp.FlushMessages
+
+	return sarama.NewAsyncProducer(kp.BrokerURL, producerConfig)
+}
+
+// Вызов fn с долгоживущим синхронным продюсером. Если продюсер ещё не подключён, то подключаем его.
+// Отправка идёт под блокировкой на чтение, поэтому Close не закроет продюсера посреди отправки
+func (kp *KafkaProducer) withSyncProducer(fn func(sarama.SyncProducer) error) error {
+	kp.mu.RLock()
+	if kp.syncProducer != nil {
+		defer kp.mu.RUnlock()
+		return fn(kp.syncProducer)
 	}
-	kp.Logger.Info(fmt.Sprintf("initialized producer for topic %v", kp.Topic))
-	defer producer.Close()
+	kp.mu.RUnlock()
 
+	kp.mu.Lock()
+	if kp.isClosed {
+		kp.mu.Unlock()
+		return ErrProducerClosed
+	}
+	if kp.syncProducer == nil {
+		producer, err := kp.connectProducer()
+		if err != nil {
+			kp.mu.Unlock()
+			return err
+		}
+		kp.syncProducer = producer
+	}
+	kp.mu.Unlock()
+	return kp.withSyncProducer(fn)
+}
+
+// То же самое для асинхронного продюсера. При подключении запускаем горутины, которые читают результаты доставки
+// и передают их в колбэк OnDelivery
+func (kp *KafkaProducer) withAsyncProducer(fn func(sarama.AsyncProducer) error) error {
+	kp.mu.RLock()
+	if kp.asyncProducer != nil {
+		defer kp.mu.RUnlock()
+		return fn(kp.asyncProducer)
+	}
+	kp.mu.RUnlock()
+
+	kp.mu.Lock()
+	if kp.isClosed {
+		kp.mu.Unlock()
+		return ErrProducerClosed
+	}
+	if kp.asyncProducer == nil {
+		producer, err := kp.connectAsyncProducer()
+		if err != nil {
+			kp.mu.Unlock()
+			return err
+		}
+		kp.asyncProducer = producer
+
+		kp.deliveries.Add(2)
+		go func() {
+			defer kp.deliveries.Done()
+			for msg := range producer.Successes() {
+				kp.OnDelivery(msg, nil)
+			}
+		}()
+		go func() {
+			defer kp.deliveries.Done()
+			for producerErr := range producer.Errors() {
+				kp.OnDelivery(producerErr.Msg, producerErr.Err)
+			}
+		}()
+	}
+	kp.mu.Unlock()
+	return kp.withAsyncProducer(fn)
+}
+
+// Колбэк по умолчанию для асинхронного режима. PushOrderToQueue к этому моменту уже вернул nil, поэтому
+// заказ, который не удалось доставить из-за недоступности брокера или таймаута, сохраняем в outbox так же,
+// как это делается для синхронного режима в обработчике. Остальные ошибки только пишем в лог
+func (kp *KafkaProducer) handleDelivery(msg *sarama.ProducerMessage, err error) {
+	if err == nil {
+		kp.Logger.Infow("delivered message", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+		return
+	}
+	logger := kp.Logger.With("topic", msg.Topic, "correlation_id", correlationIDFromProducerHeaders(msg))
+	err = classifyError(msg.Topic, err)
+	if !IsTransientError(err) || msg.Topic != kp.Topic || msg.Value == nil {
+		logger.Warnw("failed to deliver message", "error", err)
+		return
+	}
+
+	data, encodeErr := msg.Value.Encode()
+	if encodeErr == nil {
+		encodeErr = kp.DeferToOutbox(data)
+	}
+	if encodeErr != nil {
+		logger.Errorw("failed to deliver message, order is lost", "error", err, "outbox_error", encodeErr)
+		return
+	}
+	logger.Warnw("failed to deliver message, saved it to outbox", "error", err)
+}
+
+// Основной метод структуры для пуша сообщений в очередь. В синхронном режиме ждём подтверждения от брокера,
+// в асинхронном - только кладём сообщение в очередь продюсера. Ошибки возвращаются в виде SendError,
+// по типу которой вызывающий код может понять, что случилось (брокер недоступен, сообщение слишком большое, таймаут).
+// Если очередь асинхронного продюсера забита, то ждём места в ней не дольше, чем живёт ctx.
+// Correlation ID из ctx передаётся в заголовке HeaderCorrelationID
+func (kp *KafkaProducer) PushOrderToQueue(ctx context.Context, data []byte) error {
 	msg := &sarama.ProducerMessage{
-		Topic: kp.Topic,
-		Value: sarama.StringEncoder(data),
+		Topic:   kp.Topic,
+		Value:   sarama.StringEncoder(data),
+		Headers: CorrelationHeaders(ctx),
+	}
+	logger := log.FromContext(ctx, kp.Logger)
+	if err := ctx.Err(); err != nil {
+		return classifyError(kp.Topic, err)
+	}
+
+	if kp.Async {
+		start := time.Now()
+		err := kp.withAsyncProducer(func(producer sarama.AsyncProducer) error {
+			select {
+			case producer.Input() <- msg:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		metrics.KafkaProducerSendDuration.WithLabelValues(kp.Topic, metrics.Result(err)).Observe(metrics.Since(start))
+		if err != nil {
+			err = classifyError(kp.Topic, err)
+			logger.Warnw("failed on initialize producer", "topic", kp.Topic, "error", err)
+			return err
+		}
+		logger.Infow("queued message", "topic", kp.Topic)
+		return nil
+	}
+
+	if err := kp.sendMessage(msg); err != nil {
+		logger.Warnw("failed to send message", "topic", kp.Topic, "error", err)
+		return err
+	}
+	logger.Infow("sent message", "topic", kp.Topic)
+	return nil
+}
+
+// Сохранение заказа в локальный outbox, если кафка недоступна. Заказ будет отправлен в топик фоновой горутиной,
+// когда брокер снова станет доступен
+func (kp *KafkaProducer) DeferToOutbox(data []byte) error {
+	if kp.Outbox == nil {
+		return errors.New("outbox is disabled")
+	}
+	if err := kp.Outbox.Add(kp.Topic, data); err != nil {
+		kp.Logger.Warnw("failed on saving message to outbox", "topic", kp.Topic, "error", err)
+		return err
+	}
+	kp.Logger.Infow("saved message to outbox", "topic", kp.Topic, "outbox", kp.Outbox.Path)
+	return nil
+}
+
+// Отправка накопленных в outbox сообщений. Вызывается по тикеру, пока продюсер не закрыт
+func (kp *KafkaProducer) flushOutbox() {
+	sent, err := kp.Outbox.Flush(func(topic string, value []byte) error {
+		return kp.sendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)})
+	})
+	if sent > 0 {
+		kp.Logger.Infow("sent messages from outbox", "count", sent, "outbox", kp.Outbox.Path)
 	}
-	_, _, err = producer.SendMessage(msg)
 	if err != nil {
-		kp.Logger.Fatal(fmt.Sprintf("failed to send message to topic %v", kp.Topic))
+		kp.Logger.Warnw("failed on flushing outbox", "outbox", kp.Outbox.Path, "error", err)
+	}
+}
+
+// Закрытие продюсера. В асинхронном режиме сначала отправляются все накопленные сообщения, и мы дожидаемся,
+// пока их результаты доставки будут переданы в OnDelivery. Также останавливается фоновая отправка outbox
+func (kp *KafkaProducer) Close() error {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if kp.isClosed {
+		return nil
+	}
+	kp.isClosed = true
+	close(kp.closed)
+
+	var errs []error
+	if kp.asyncProducer != nil {
+		kp.asyncProducer.AsyncClose()
+		kp.deliveries.Wait()
+		kp.asyncProducer = nil
+	}
+	if kp.syncProducer != nil {
+		errs = append(errs, kp.syncProducer.Close())
+		kp.syncProducer = nil
+	}
+	if err := errors.Join(errs...); err != nil {
+		kp.Logger.Warnw("failed on closing producer", "error", err)
 		return err
 	}
-	kp.Logger.Info(fmt.Sprintf("sent message to topic %v", kp.Topic))
+	kp.Logger.Infow("producer closed", "topic", kp.Topic)
 	return nil
 }
+
+// Отправка сообщения, которое не удалось обработать, в dead-letter топик. Тело и ключ сообщения не меняются,
+// к заголовкам исходного сообщения добавляются стадия и текст ошибки, исходные партиция и offset
+// и количество попыток обработки. В отличие от PushOrderToQueue ошибка отправки возвращается вызывающему коду,
+// чтобы он не коммитил offset исходного сообщения
+func (kp *KafkaProducer) PushToDeadLetter(message *sarama.ConsumerMessage, failure *handlers.QueryFailure,
+	attempts int) error {
+	msg := DeadLetterMessage(kp.DeadLetterTopic, message, failure, attempts)
+	if err := kp.sendMessage(msg); err != nil {
+		kp.Logger.Warnw("failed to send message to dead-letter topic", "topic", kp.DeadLetterTopic,
+			"partition", message.Partition, "offset", message.Offset, "correlation_id", CorrelationIDFromHeaders(message),
+			"error", err)
+		return err
+	}
+	kp.Logger.Infow("sent message to dead-letter topic", "topic", kp.DeadLetterTopic,
+		"partition", message.Partition, "offset", message.Offset, "correlation_id", CorrelationIDFromHeaders(message))
+	return nil
+}
+
+// Сборка сообщения для dead-letter топика из исходного сообщения и причины ошибки
+func DeadLetterMessage(topic string, message *sarama.ConsumerMessage, failure *handlers.QueryFailure,
+	attempts int) *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+7)
+	for _, header := range message.Headers {
+		if header != nil && !isDeadLetterHeader(string(header.Key)) {
+			headers = append(headers, *header)
+		}
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderFailureStage), Value: []byte(failure.Stage)},
+		sarama.RecordHeader{Key: []byte(HeaderFailureCode), Value: []byte(strconv.Itoa(failure.Code))},
+		sarama.RecordHeader{Key: []byte(HeaderError), Value: []byte(failure.Error)},
+		sarama.RecordHeader{Key: []byte(HeaderOriginalTopic), Value: []byte(message.Topic)},
+		sarama.RecordHeader{Key: []byte(HeaderOriginalPartition), Value: []byte(strconv.Itoa(int(message.Partition)))},
+		sarama.RecordHeader{Key: []byte(HeaderOriginalOffset), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(HeaderAttempts), Value: []byte(strconv.Itoa(attempts))},
+	)
+
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	}
+	if message.Key != nil {
+		msg.Key = sarama.ByteEncoder(message.Key)
+	}
+	return msg
+}
+
+// Количество попыток обработки, записанное в заголовках сообщения. Если сообщение переотправили из dead-letter
+// топика обратно в основной, то счётчик продолжится с прошлого значения
+func AttemptsFromHeaders(message *sarama.ConsumerMessage) int {
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == HeaderAttempts {
+			attempts, err := strconv.Atoi(string(header.Value))
+			if err == nil {
+				return attempts
+			}
+		}
+	}
+	return 0
+}
+
+// Correlation ID, записанный в заголовках сообщения, или пустая строка, если его нет
+func CorrelationIDFromHeaders(message *sarama.ConsumerMessage) string {
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == HeaderCorrelationID {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func correlationIDFromProducerHeaders(msg *sarama.ProducerMessage) string {
+	for _, header := range msg.Headers {
+		if string(header.Key) == HeaderCorrelationID {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Заголовки с correlation ID из ctx для исходящего сообщения. Если в ctx его нет, то заголовков нет
+func CorrelationHeaders(ctx context.Context) []sarama.RecordHeader {
+	correlationID := log.CorrelationID(ctx)
+	if correlationID == "" {
+		return nil
+	}
+	return []sarama.RecordHeader{{Key: []byte(HeaderCorrelationID), Value: []byte(correlationID)}}
+}
+
+// Синхронная отправка одного сообщения, ошибка оборачивается в SendError. Используется
+// и в асинхронном режиме там, где нужно подтверждение от брокера (например, для dead-letter топика).
+// Длительность отправки пишется в метрики; в асинхронном режиме в них попадает только время постановки в очередь
+func (kp *KafkaProducer) sendMessage(msg *sarama.ProducerMessage) error {
+	start := time.Now()
+	err := kp.withSyncProducer(func(producer sarama.SyncProducer) error {
+		_, _, err := producer.SendMessage(msg)
+		return err
+	})
+	metrics.KafkaProducerSendDuration.WithLabelValues(msg.Topic, metrics.Result(err)).Observe(metrics.Since(start))
+	return classifyError(msg.Topic, err)
+}
+
+func isDeadLetterHeader(key string) bool {
+	switch key {
+	case HeaderFailureStage, HeaderFailureCode, HeaderError, HeaderOriginalTopic,
+		HeaderOriginalPartition, HeaderOriginalOffset, HeaderAttempts:
+		return true
+	}
+	return false
+}
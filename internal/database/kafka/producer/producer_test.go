@@ -0,0 +1,31 @@
+package producer
+
+import (
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleDeliveryDefersTransientFailuresToOutbox(t *testing.T) {
+	outbox, err := NewOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp := &KafkaProducer{Topic: "orders", Outbox: outbox, Logger: zap.NewNop().Sugar()}
+
+	kp.handleDelivery(&sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder("lost")}, sarama.ErrOutOfBrokers)
+	kp.handleDelivery(&sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder("too large")},
+		sarama.ErrMessageSizeTooLarge)
+
+	var values []string
+	if _, err = outbox.Flush(func(topic string, value []byte) error {
+		values = append(values, topic+":"+string(value))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0] != "orders:lost" {
+		t.Fatalf("expected only transient failure in outbox, got %v", values)
+	}
+}
@@ -1,8 +1,16 @@
 package postgres
 
-// Интерфейс для работы с Postgres
+import (
+	"context"
+	abstr "github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"time"
+)
+
+// Интерфейс для работы с Postgres: репозиторий заказов, выборка изменившихся заказов для обновления кэша
+// и проверка доступности базы (для readiness)
 type IPostgresDatabase interface {
-	CreateOrder(out chan interface{}, data []byte)
-	GetOrder(out chan interface{}, data []byte)
-	GrepOrdersFromDatabase(out chan interface{})
+	abstr.OrderRepository
+	ListUpdatedSince(ctx context.Context, since time.Time, limit int) (*abstr.OrdersChanges, error)
+	Ping(ctx context.Context) error
+	Close() error
 }
@@ -0,0 +1,441 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	abstr "github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	pg "github.com/nehachuha1/wbtech-tasks/internal/migrations/postgres"
+	dbutils "github.com/nehachuha1/wbtech-tasks/pkg/database"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"go.uber.org/zap"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Операции MemoryDatabase, на стадии которых можно внедрить ошибку. У OpPing стадия пустая
+const (
+	OpWrite = "write"
+	OpRead  = "read"
+	OpPing  = "ping"
+)
+
+// Ошибка, которую возвращает MemoryDatabase после Close
+var ErrMemoryDatabaseClosed = errors.New("memory database is closed")
+
+// Хранилище заказов в памяти, реализующее IPostgresDatabase. Нужно для тестов без живого Postgres, поэтому
+// повторяет поведение PostgresDatabase: заказ так же декомпозируется на строки orders, deliveries, payments
+// и order_items и собирается обратно при чтении, предыдущие версии заказа сохраняются, запись идемпотентна по хэшу содержимого и учитывает ConflictPolicy,
+// ошибки оборачиваются в StageError с теми же стадиями и кодами.
+// Запись атомарна: строки применяются только после того, как все стадии прошли успешно.
+// Для проверки обработки ошибок есть FailOn (ошибка на заданной стадии) и BeforeStage (произвольный хук, например
+// с задержкой до истечения ctx). Now задаёт время записи updated_at, по умолчанию - текущее
+type MemoryDatabase struct {
+	Logger         *zap.SugaredLogger
+	ConflictPolicy string
+	Now            func() time.Time
+	BeforeStage    func(ctx context.Context, op string, stage string) error
+
+	mu         sync.Mutex
+	orders     map[string]pg.Order
+	deliveries map[string]pg.Delivery
+	payments   map[string]pg.Payment
+	items      map[string][]pg.Item
+	versions   map[string][]pg.OrderVersion
+	failures   []*injectedFailure
+	isClosed   bool
+}
+
+// Внедрённая ошибка. remaining <= 0 - ошибка возвращается до вызова ResetFailures
+type injectedFailure struct {
+	op        string
+	stage     string
+	err       error
+	remaining int
+}
+
+// Инициализация пустого хранилища в памяти
+func NewMemoryDatabase(conflictPolicy string, logger *zap.SugaredLogger) *MemoryDatabase {
+	return &MemoryDatabase{
+		Logger:         logger,
+		ConflictPolicy: conflictPolicy,
+		orders:         make(map[string]pg.Order),
+		deliveries:     make(map[string]pg.Delivery),
+		payments:       make(map[string]pg.Payment),
+		items:          make(map[string][]pg.Item),
+		versions:       make(map[string][]pg.OrderVersion),
+	}
+}
+
+// Следующие times операций op (OpWrite или OpRead) упадут с ошибкой err на стадии stage (StageLookup, StageOrders и т.д.).
+// Если times <= 0, то ошибка возвращается, пока не будет вызван ResetFailures. Временность ошибки определяется
+// так же, как для Postgres (IsTransientError), поэтому для временной ошибки можно передать, например,
+// &pgconn.PgError{Code: "40P01"}
+func (m *MemoryDatabase) FailOn(op string, stage string, err error, times int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, &injectedFailure{op: op, stage: stage, err: err, remaining: times})
+}
+
+// Удаление всех внедрённых ошибок
+func (m *MemoryDatabase) ResetFailures() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = nil
+}
+
+// Закрытие хранилища: после него все операции возвращают ErrMemoryDatabaseClosed
+func (m *MemoryDatabase) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.isClosed = true
+	return nil
+}
+
+// Проверка доступности хранилища. Ошибку можно внедрить через FailOn(OpPing, "", ...)
+func (m *MemoryDatabase) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkStage(ctx, OpPing, "")
+}
+
+// Создание заказа. Семантика та же, что у PostgresDatabase.Create
+func (m *MemoryDatabase) Create(ctx context.Context, order *abstr.Order) error {
+	canonicalOrder, err := json.Marshal(order)
+	if err != nil {
+		return &abstr.StageError{Stage: StageUnmarshal, Code: ErrOnUnmarshal, Err: err}
+	}
+	version, err := m.writeOrder(ctx, order, dbutils.HashContent(canonicalOrder))
+	logger := log.FromContext(ctx, m.Logger)
+	switch {
+	case err == nil:
+		logger.Infow("added order to memory database", "order_uid", order.OrderUid, "version", version)
+		return nil
+	case errors.Is(err, abstr.ErrDuplicate):
+		return err
+	}
+
+	stageErr := toStageError(err)
+	logger.Warnw("write rolled back", "order_uid", order.OrderUid, "stage", stageErr.Stage, "error", stageErr.Err)
+	return stageErr
+}
+
+// Запись заказа. Все стадии проходят под блокировкой, а строки применяются только в конце - так же, как
+// при коммите транзакции в Postgres
+func (m *MemoryDatabase) writeOrder(ctx context.Context, orderFromJSON *abstr.Order, contentHash string) (int, error) {
+	newDelivery := makeNewDelivery(orderFromJSON)
+	newPayment := makeNewPayment(orderFromJSON)
+	newItems := makeNewItems(orderFromJSON)
+	newOrder := makeNewOrderFromJSON(orderFromJSON)
+	newOrder.ContentHash = contentHash
+	newOrder.Version = 1
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkStage(ctx, OpWrite, StageLookup); err != nil {
+		return 0, &abstr.StageError{Stage: StageLookup, Code: ErrOnFindRow,
+			Err: wrapError(nil, err, "failed on looking up existing order")}
+	}
+	existingOrder, isExists := m.orders[orderFromJSON.OrderUid]
+	var previousVersion *pg.OrderVersion
+	if isExists {
+		if existingOrder.ContentHash == contentHash {
+			return existingOrder.Version, abstr.ErrDuplicate
+		}
+		if m.ConflictPolicy != ConflictPolicyVersion {
+			return 0, &abstr.StageError{Stage: StageConflict, Code: ErrOnConflict,
+				Err: fmt.Errorf("order with order_uid %v: %w", orderFromJSON.OrderUid, abstr.ErrConflict)}
+		}
+		if err := m.checkStage(ctx, OpWrite, StageConflict); err != nil {
+			return 0, &abstr.StageError{Stage: StageConflict, Code: ErrOnDeleteRow,
+				Err: wrapError(nil, err, "failed on removing previous version of order")}
+		}
+		assembled, hasRows := m.assemble(existingOrder)
+		if !hasRows {
+			return 0, &abstr.StageError{Stage: StageConflict, Code: ErrOnCreateRow,
+				Err: fmt.Errorf("failed on saving previous version of order: order with order_uid %v has no "+
+					"delivery or payment", existingOrder.OrderUid)}
+		}
+		content, err := json.Marshal(assembled)
+		if err != nil {
+			return 0, &abstr.StageError{Stage: StageConflict, Code: ErrOnCreateRow,
+				Err: wrapError(nil, err, "failed on saving previous version of order")}
+		}
+		previousVersion = &pg.OrderVersion{OrderUid: existingOrder.OrderUid, Version: existingOrder.Version,
+			ContentHash: existingOrder.ContentHash, Content: string(content)}
+		newOrder.Version = existingOrder.Version + 1
+	}
+
+	stages := []struct {
+		stage string
+		table string
+	}{
+		{StageOrders, "orders"},
+		{StageDeliveries, "deliveries"},
+		{StagePayments, "payments"},
+		{StageItems, "order_items"},
+	}
+	for _, step := range stages {
+		if step.stage == StageItems && len(newItems) == 0 {
+			continue
+		}
+		if err := m.checkStage(ctx, OpWrite, step.stage); err != nil {
+			return 0, &abstr.StageError{Stage: step.stage, Code: ErrOnCreateRow,
+				Err: wrapError(nil, err, fmt.Sprintf("failed on creating new rows in %v table", step.table))}
+		}
+	}
+	if err := m.checkStage(ctx, OpWrite, StageCommit); err != nil {
+		return 0, err
+	}
+
+	newOrder.UpdatedAt = m.now()
+	if previousVersion != nil {
+		previousVersion.ReplacedAt = newOrder.UpdatedAt
+		m.versions[newOrder.OrderUid] = append(m.versions[newOrder.OrderUid], *previousVersion)
+	}
+	m.orders[newOrder.OrderUid] = *newOrder
+	m.deliveries[newOrder.OrderUid] = *newDelivery
+	m.payments[newOrder.OrderUid] = *newPayment
+	orderItems := make([]pg.Item, 0, len(newItems))
+	for _, item := range newItems {
+		orderItems = append(orderItems, *item)
+	}
+	m.items[newOrder.OrderUid] = orderItems
+	return newOrder.Version, nil
+}
+
+// Получение заказа. Если заказа нет, возвращается ErrNotFound
+func (m *MemoryDatabase) Get(ctx context.Context, orderUid string) (*abstr.Order, error) {
+	fetchedOrders, err := m.GetMany(ctx, []string{orderUid})
+	if err != nil {
+		return nil, err
+	}
+	if len(fetchedOrders) == 0 {
+		return nil, fmt.Errorf("order with order_uid %v: %w", orderUid, abstr.ErrNotFound)
+	}
+	return fetchedOrders[0], nil
+}
+
+// Получение сразу нескольких заказов, ненайденные пропускаются
+func (m *MemoryDatabase) GetMany(ctx context.Context, orderUids []string) ([]*abstr.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkStage(ctx, OpRead, StageOrders); err != nil {
+		return nil, findError(StageOrders, wrapError(nil, err, "failed on getting rows in orders table"))
+	}
+	orders := make([]pg.Order, 0, len(orderUids))
+	for _, orderUid := range orderUids {
+		if order, isExists := m.orders[orderUid]; isExists {
+			orders = append(orders, order)
+		}
+	}
+	return m.loadOrders(ctx, orders)
+}
+
+// Заказы, записанные позже since, по возрастанию updated_at. Нулевой since - все заказы, limit > 0 - только
+// limit последних записанных
+func (m *MemoryDatabase) ListUpdatedSince(ctx context.Context, since time.Time, limit int) (*abstr.OrdersChanges,
+	error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkStage(ctx, OpRead, StageOrders); err != nil {
+		return nil, findError(StageOrders, wrapError(nil, err, "failed on getting changed rows in orders table"))
+	}
+	changedOrders := make([]pg.Order, 0, len(m.orders))
+	for _, order := range m.orders {
+		if since.IsZero() || order.UpdatedAt.After(since) {
+			changedOrders = append(changedOrders, order)
+		}
+	}
+	slices.SortFunc(changedOrders, func(a, b pg.Order) int {
+		if c := a.UpdatedAt.Compare(b.UpdatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.OrderUid, b.OrderUid)
+	})
+	if limit > 0 && len(changedOrders) > limit {
+		changedOrders = changedOrders[len(changedOrders)-limit:]
+	}
+
+	assembled, err := m.assembleOrders(ctx, changedOrders)
+	if err != nil {
+		return nil, err
+	}
+	changes := &abstr.OrdersChanges{
+		Orders:    assembled,
+		Watermark: since,
+	}
+	for _, order := range changedOrders {
+		if order.UpdatedAt.After(changes.Watermark) {
+			changes.Watermark = order.UpdatedAt
+		}
+	}
+	return changes, nil
+}
+
+// Страница заказов с теми же фильтрами и keyset-пагинацией по (date_created, order_uid), что и в PostgresDatabase.List
+func (m *MemoryDatabase) List(ctx context.Context, filter *abstr.OrdersFilter) (*abstr.OrdersPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkStage(ctx, OpRead, StageOrders); err != nil {
+		return nil, findError(StageOrders, wrapError(nil, err, "failed on listing rows in orders table"))
+	}
+	pageOrders := make([]pg.Order, 0)
+	for _, order := range m.orders {
+		if matchesFilter(&order, filter) {
+			pageOrders = append(pageOrders, order)
+		}
+	}
+	slices.SortFunc(pageOrders, func(a, b pg.Order) int {
+		return -compareKeyset(a.DateCreated, a.OrderUid, b.DateCreated, b.OrderUid)
+	})
+
+	page := &abstr.OrdersPage{}
+	if len(pageOrders) > filter.Limit {
+		page.HasMore = true
+		pageOrders = pageOrders[:filter.Limit]
+	}
+	assembled, err := m.assembleOrders(ctx, pageOrders)
+	if err != nil {
+		return nil, err
+	}
+	page.Orders = assembled
+	return page, nil
+}
+
+// Сборка заказов, при ошибке возвращается ошибка (как в PostgresDatabase.assembleOrders)
+func (m *MemoryDatabase) assembleOrders(ctx context.Context, orders []pg.Order) ([]*abstr.Order, error) {
+	fetchedOrders, err := m.loadOrders(ctx, orders)
+	if err != nil {
+		log.FromContext(ctx, m.Logger).Warnw("failed on assembling batch of orders", "count", len(orders),
+			"error", err)
+		return nil, err
+	}
+	return fetchedOrders, nil
+}
+
+// Загрузка доставок, платежей и вещей для заказов и сборка заказов в формат JSON. Стадии чтения те же, что
+// и у PostgresDatabase.loadOrders
+func (m *MemoryDatabase) loadOrders(ctx context.Context, orders []pg.Order) ([]*abstr.Order, error) {
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	if err := m.checkStage(ctx, OpRead, StageDeliveries); err != nil {
+		return nil, findError(StageDeliveries, wrapError(nil, err, "failed on find rows in deliveries table"))
+	}
+	if err := m.checkStage(ctx, OpRead, StagePayments); err != nil {
+		return nil, findError(StagePayments, wrapError(nil, err, "failed on find rows in payments table"))
+	}
+	if err := m.checkStage(ctx, OpRead, StageItems); err != nil {
+		return nil, findError(StageItems, wrapError(nil, err, "failed on find rows in order_items table"))
+	}
+
+	fetchedOrders := make([]*abstr.Order, 0, len(orders))
+	for _, order := range orders {
+		assembled, hasRows := m.assemble(order)
+		if !hasRows {
+			log.FromContext(ctx, m.Logger).Warnw("can't find delivery or payment for order",
+				"order_uid", order.OrderUid)
+			continue
+		}
+		fetchedOrders = append(fetchedOrders, assembled)
+	}
+	return fetchedOrders, nil
+}
+
+// Сборка одного заказа из строк. Если у заказа нет доставки или платежа, возвращается false.
+// Вызывается под блокировкой
+func (m *MemoryDatabase) assemble(order pg.Order) (*abstr.Order, bool) {
+	delivery, hasDelivery := m.deliveries[order.OrderUid]
+	payment, hasPayment := m.payments[order.OrderUid]
+	if !hasDelivery || !hasPayment {
+		return nil, false
+	}
+	order.Delivery = delivery
+	order.Payment = payment
+	order.Items = slices.Clone(m.items[order.OrderUid])
+	return convertOrder(&order), true
+}
+
+// Проверка перед стадией операции: не истёк ли ctx, не закрыто ли хранилище, нет ли внедрённой ошибки.
+// Вызывается под блокировкой
+func (m *MemoryDatabase) checkStage(ctx context.Context, op string, stage string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.isClosed {
+		return ErrMemoryDatabaseClosed
+	}
+	for idx, failure := range m.failures {
+		if failure.op != op || failure.stage != stage {
+			continue
+		}
+		if failure.remaining > 0 {
+			failure.remaining--
+			if failure.remaining == 0 {
+				m.failures = slices.Delete(m.failures, idx, idx+1)
+			}
+		}
+		return failure.err
+	}
+	if m.BeforeStage != nil {
+		return m.BeforeStage(ctx, op, stage)
+	}
+	return nil
+}
+
+func (m *MemoryDatabase) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// Проверка заказа на соответствие фильтру списка заказов. Даты сравниваются как моменты времени, так же как
+// в запросе к Postgres. Заказ без даты (нулевое время) не попадает под фильтры по датам и идёт в конце списка,
+// как NULL в Postgres; пустая дата в курсоре означает такой заказ
+func matchesFilter(order *pg.Order, filter *abstr.OrdersFilter) bool {
+	if filter.CustomerId != "" && order.CustomerId != filter.CustomerId {
+		return false
+	}
+	if filter.TrackNumber != "" && order.TrackNumber != filter.TrackNumber {
+		return false
+	}
+	if filter.DeliveryService != "" && order.DeliveryService != filter.DeliveryService {
+		return false
+	}
+	if filter.Locale != "" && order.Locale != filter.Locale {
+		return false
+	}
+	if (filter.DateFrom != "" || filter.DateTo != "") && order.DateCreated.IsZero() {
+		return false
+	}
+	if dateFrom, err := abstr.ParseTimestamp(filter.DateFrom); err == nil && order.DateCreated.Before(dateFrom) {
+		return false
+	}
+	if dateTo, err := abstr.ParseTimestamp(filter.DateTo); err == nil && !order.DateCreated.Before(dateTo) {
+		return false
+	}
+	if filter.AfterOrderUid != "" {
+		afterDateCreated, _ := abstr.ParseTimestamp(filter.AfterDateCreated)
+		if compareKeyset(order.DateCreated, order.OrderUid, afterDateCreated, filter.AfterOrderUid) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Сравнение пар (date_created, order_uid) как кортежей. Нулевое время меньше любой даты
+func compareKeyset(dateCreatedA time.Time, orderUidA string, dateCreatedB time.Time, orderUidB string) int {
+	if c := dateCreatedA.Compare(dateCreatedB); c != 0 {
+		return c
+	}
+	return strings.Compare(orderUidA, orderUidB)
+}
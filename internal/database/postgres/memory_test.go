@@ -0,0 +1,279 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	abstr "github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/testutil"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func newTestMemoryDatabase(conflictPolicy string) *MemoryDatabase {
+	return NewMemoryDatabase(conflictPolicy, zap.NewNop().Sugar())
+}
+
+func assertSameOrder(t *testing.T, expected *abstr.Order, actual *abstr.Order) {
+	t.Helper()
+	expectedJSON, _ := json.Marshal(expected)
+	actualJSON, _ := json.Marshal(actual)
+	if string(expectedJSON) != string(actualJSON) {
+		t.Fatalf("orders differ:\nexpected %s\nactual   %s", expectedJSON, actualJSON)
+	}
+}
+
+func TestMemoryDatabaseRoundTrip(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	order := testutil.Order(t, "b563feb7b2b84b6test", testutil.DateCreated)
+
+	if err := db.Create(context.Background(), order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if len(db.items[order.OrderUid]) != 2 || db.items[order.OrderUid][1].Position != 1 {
+		t.Fatalf("order items are not decomposed by position: %+v", db.items[order.OrderUid])
+	}
+	fetched, err := db.Get(context.Background(), order.OrderUid)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	assertSameOrder(t, order, fetched)
+
+	if _, err = db.Get(context.Background(), "missing"); !errors.Is(err, abstr.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryDatabaseConflictPolicies(t *testing.T) {
+	order := testutil.Order(t, "conflicting", testutil.DateCreated)
+	changed := testutil.Order(t, "conflicting", testutil.DateCreated)
+	changed.Locale = "ru"
+
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	if err := db.Create(context.Background(), order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := db.Create(context.Background(), order); !errors.Is(err, abstr.ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+	err := db.Create(context.Background(), changed)
+	var stageErr *abstr.StageError
+	if !errors.Is(err, abstr.ErrConflict) || !errors.As(err, &stageErr) || stageErr.Stage != StageConflict {
+		t.Fatalf("expected conflict on stage %v, got %v", StageConflict, err)
+	}
+
+	// Соседний заказ с теми же chrt_id не должен пострадать от замены версии
+	neighbour := testutil.Order(t, "neighbour", testutil.DateCreated)
+	db = newTestMemoryDatabase(ConflictPolicyVersion)
+	if err = db.Create(context.Background(), order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err = db.Create(context.Background(), neighbour); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err = db.Create(context.Background(), changed); err != nil {
+		t.Fatalf("create new version: %v", err)
+	}
+	if version := db.orders[order.OrderUid].Version; version != 2 {
+		t.Fatalf("expected version 2, got %v", version)
+	}
+	fetched, err := db.Get(context.Background(), order.OrderUid)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	assertSameOrder(t, changed, fetched)
+	// Предыдущая версия не теряется
+	versions := db.versions[order.OrderUid]
+	if len(versions) != 1 || versions[0].Version != 1 {
+		t.Fatalf("expected saved version 1, got %+v", versions)
+	}
+	previous := &abstr.Order{}
+	if err = json.Unmarshal([]byte(versions[0].Content), previous); err != nil {
+		t.Fatalf("unmarshal previous version: %v", err)
+	}
+	assertSameOrder(t, order, previous)
+	if fetched, err = db.Get(context.Background(), neighbour.OrderUid); err != nil {
+		t.Fatalf("get neighbour: %v", err)
+	}
+	assertSameOrder(t, neighbour, fetched)
+}
+
+func TestMemoryDatabaseRollsBackFailedWrite(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	order := testutil.Order(t, "rolled-back", testutil.DateCreated)
+	db.FailOn(OpWrite, StageItems, errors.New("check constraint violated"), 1)
+
+	err := db.Create(context.Background(), order)
+	var stageErr *abstr.StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != StageItems || stageErr.Code != ErrOnCreateRow {
+		t.Fatalf("expected error on stage %v, got %v", StageItems, err)
+	}
+	if stageErr.Transient {
+		t.Fatalf("constraint violation must not be transient")
+	}
+	if len(db.orders)+len(db.deliveries)+len(db.payments)+len(db.items) != 0 {
+		t.Fatalf("failed write left rows behind")
+	}
+
+	if err = db.Create(context.Background(), order); err != nil {
+		t.Fatalf("failure must be injected only once, got %v", err)
+	}
+}
+
+func TestMemoryDatabaseTransientFailures(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	db.FailOn(OpWrite, StageCommit, &pgconn.PgError{Code: deadlockDetectedCode}, 0)
+
+	err := db.Create(context.Background(), testutil.Order(t, "deadlocked", testutil.DateCreated))
+	if !abstr.IsTransient(err) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	db.ResetFailures()
+	if err = db.Create(context.Background(), testutil.Order(t, "deadlocked", testutil.DateCreated)); err != nil {
+		t.Fatalf("create after reset: %v", err)
+	}
+
+	db.FailOn(OpRead, StagePayments, &pgconn.PgError{Code: adminShutdownCode}, 1)
+	if _, err = db.Get(context.Background(), "deadlocked"); !abstr.IsTransient(err) {
+		t.Fatalf("expected transient read error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = db.Get(ctx, "deadlocked"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMemoryDatabaseListPagination(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	for idx, orderUid := range []string{"a", "b", "c", "d", "e"} {
+		dateCreated := fmt.Sprintf("2021-11-2%vT06:22:19Z", idx)
+		if err := db.Create(context.Background(), testutil.Order(t, orderUid, dateCreated)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	var listed []string
+	filter := &abstr.OrdersFilter{Limit: 2}
+	for {
+		page, err := db.List(context.Background(), filter)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		for _, order := range page.Orders {
+			listed = append(listed, order.OrderUid)
+		}
+		if !page.HasMore {
+			break
+		}
+		last := page.Orders[len(page.Orders)-1]
+		filter.AfterDateCreated, filter.AfterOrderUid = last.DateCreated, last.OrderUid
+	}
+	if fmt.Sprint(listed) != "[e d c b a]" {
+		t.Fatalf("unexpected order of pages: %v", listed)
+	}
+
+	page, err := db.List(context.Background(), &abstr.OrdersFilter{
+		DateFrom: "2021-11-21T00:00:00Z", DateTo: "2021-11-23T00:00:00Z", Limit: 10,
+	})
+	if err != nil {
+		t.Fatalf("list by dates: %v", err)
+	}
+	if len(page.Orders) != 2 || page.Orders[0].OrderUid != "c" || page.Orders[1].OrderUid != "b" {
+		t.Fatalf("unexpected orders in date range: %+v", page.Orders)
+	}
+}
+
+// Даты с разными часовыми поясами и долями секунды сортируются и листаются как моменты времени, а не как строки
+func TestMemoryDatabaseListComparesDatesAsTimestamps(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	for orderUid, dateCreated := range map[string]string{
+		"moscow":   "2021-11-26T09:00:00+03:00",
+		"utc":      "2021-11-26T06:30:00Z",
+		"fraction": "2021-11-26T06:30:00.5Z",
+	} {
+		if err := db.Create(context.Background(), testutil.Order(t, orderUid, dateCreated)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	var listed []string
+	filter := &abstr.OrdersFilter{DateFrom: "2021-11-26T06:00:00Z", Limit: 1}
+	for {
+		page, err := db.List(context.Background(), filter)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		for _, order := range page.Orders {
+			listed = append(listed, order.OrderUid+"@"+order.DateCreated)
+		}
+		if !page.HasMore {
+			break
+		}
+		last := page.Orders[len(page.Orders)-1]
+		filter.AfterDateCreated, filter.AfterOrderUid = last.DateCreated, last.OrderUid
+	}
+	expected := "[fraction@2021-11-26T06:30:00.5Z utc@2021-11-26T06:30:00Z moscow@2021-11-26T06:00:00Z]"
+	if fmt.Sprint(listed) != expected {
+		t.Fatalf("unexpected order of pages: %v", listed)
+	}
+}
+
+func TestMemoryDatabaseListUpdatedSince(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	for _, orderUid := range []string{"first", "second", "third"} {
+		if err := db.Create(context.Background(), testutil.Order(t, orderUid, testutil.DateCreated)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	changes, err := db.ListUpdatedSince(context.Background(), time.Time{}, 0)
+	if err != nil {
+		t.Fatalf("list all: %v", err)
+	}
+	if len(changes.Orders) != 3 || !changes.Watermark.Equal(clock) {
+		t.Fatalf("expected 3 orders with watermark %v, got %v with %v", clock, len(changes.Orders), changes.Watermark)
+	}
+
+	changes, err = db.ListUpdatedSince(context.Background(), clock.Add(-time.Second), 0)
+	if err != nil {
+		t.Fatalf("list changed: %v", err)
+	}
+	if len(changes.Orders) != 1 || changes.Orders[0].OrderUid != "third" {
+		t.Fatalf("expected only the last order, got %+v", changes.Orders)
+	}
+
+	changes, err = db.ListUpdatedSince(context.Background(), time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("list latest: %v", err)
+	}
+	if len(changes.Orders) != 2 || changes.Orders[0].OrderUid != "second" || changes.Orders[1].OrderUid != "third" ||
+		!changes.Watermark.Equal(clock) {
+		t.Fatalf("expected two latest orders with watermark %v, got %+v with %v", clock, changes.Orders,
+			changes.Watermark)
+	}
+}
+
+func TestMemoryDatabaseFailsListingWhenAssemblyFails(t *testing.T) {
+	db := newTestMemoryDatabase(ConflictPolicyReject)
+	if err := db.Create(context.Background(), testutil.Order(t, "listed", testutil.DateCreated)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	db.FailOn(OpRead, StageDeliveries, &pgconn.PgError{Code: adminShutdownCode}, 2)
+	if _, err := db.List(context.Background(), &abstr.OrdersFilter{Limit: 10}); !abstr.IsTransient(err) {
+		t.Fatalf("expected transient list error, got %v", err)
+	}
+	if changes, err := db.ListUpdatedSince(context.Background(), time.Time{}, 0); !abstr.IsTransient(err) {
+		t.Fatalf("expected transient error instead of partial changes, got %+v, %v", changes, err)
+	}
+}
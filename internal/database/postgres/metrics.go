@@ -0,0 +1,56 @@
+package postgres
+
+import (
+	"errors"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"gorm.io/gorm"
+	"time"
+)
+
+const queryStartKey = "metrics:query_start"
+
+// Плагин gorm, который пишет длительность каждого запроса в метрики. Запросы различаются по типу и таблице
+// ("select orders", "insert order_items"), так что по метрикам видно, какая стадия записи или чтения заказа тормозит
+type QueryMetrics struct{}
+
+func (QueryMetrics) Name() string {
+	return "metrics:query_duration"
+}
+
+// Регистрация колбэков до и после каждого типа запросов gorm
+func (QueryMetrics) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("metrics:before_create", startQuery),
+		callbacks.Create().After("gorm:create").Register("metrics:after_create", observeQuery("insert")),
+		callbacks.Query().Before("gorm:query").Register("metrics:before_query", startQuery),
+		callbacks.Query().After("gorm:query").Register("metrics:after_query", observeQuery("select")),
+		callbacks.Update().Before("gorm:update").Register("metrics:before_update", startQuery),
+		callbacks.Update().After("gorm:update").Register("metrics:after_update", observeQuery("update")),
+		callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", startQuery),
+		callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", observeQuery("delete")),
+		callbacks.Row().Before("gorm:row").Register("metrics:before_row", startQuery),
+		callbacks.Row().After("gorm:row").Register("metrics:after_row", observeQuery("select")),
+		callbacks.Raw().Before("gorm:raw").Register("metrics:before_raw", startQuery),
+		callbacks.Raw().After("gorm:raw").Register("metrics:after_raw", observeQuery("raw")),
+	)
+}
+
+func startQuery(db *gorm.DB) {
+	db.InstanceSet(queryStartKey, time.Now())
+}
+
+func observeQuery(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		value, isExists := db.InstanceGet(queryStartKey)
+		start, isTime := value.(time.Time)
+		if !isExists || !isTime {
+			return
+		}
+		statement := operation
+		if db.Statement.Table != "" {
+			statement += " " + db.Statement.Table
+		}
+		metrics.PostgresQueryDuration.WithLabelValues(statement).Observe(metrics.Since(start))
+	}
+}
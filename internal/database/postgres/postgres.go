@@ -1,220 +1,486 @@
 package postgres
 
 import (
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/lib/pq"
+	"github.com/jackc/pgx/v5/pgconn"
 	abstr "github.com/nehachuha1/wbtech-tasks/internal/handlers"
 	pg "github.com/nehachuha1/wbtech-tasks/internal/migrations/postgres"
 	dbutils "github.com/nehachuha1/wbtech-tasks/pkg/database"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
-	"strconv"
+	"gorm.io/gorm/clause"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
 	ErrOnCreateRow = 510 + iota
 	ErrOnFindRow
+	ErrOnCommitTx
+	ErrOnUnmarshal
+	ErrOnConflict
+	ErrOnDeleteRow
 )
 
+// Стадии записи заказа в базу. Стадия, на которой упал запрос, попадает в handlers.StageError
+const (
+	StageUnmarshal  = "unmarshal"
+	StageDeliveries = "deliveries"
+	StagePayments   = "payments"
+	StageItems      = "items"
+	StageOrders     = "orders"
+	StageCommit     = "commit"
+	StageLookup     = "lookup"
+	StageConflict   = "conflict"
+)
+
+// Политики обработки заказа, order_uid которого уже есть в базе, но содержимое отличается
+const (
+	ConflictPolicyReject  = "reject"
+	ConflictPolicyVersion = "version"
+)
+
+// Сколько заказов собирается за один заход в loadOrders: ограничивает размер IN-списков в запросах
+const assembleBatchSize = 1000
+
+// Коды ошибок Postgres: нарушение уникального индекса и ошибки, после которых запрос можно повторить
+const (
+	uniqueViolationCode      = "23505"
+	serializationFailureCode = "40001"
+	deadlockDetectedCode     = "40P01"
+	tooManyConnectionsCode   = "53300"
+	adminShutdownCode        = "57P01"
+	crashShutdownCode        = "57P02"
+	cannotConnectNowCode     = "57P03"
+	connectionExceptionClass = "08"
+)
+
+var errOrderUidTaken = errors.New("order_uid is already taken by concurrent transaction")
+
 // Управляющая структура для базы данных Postgres. Работа с БД происходит через либу gorm
 type PostgresDatabase struct {
 	DatabaseConnection *gorm.DB
 	Logger             *zap.SugaredLogger
-	Quit               chan bool
+	ConflictPolicy     string
+	QueryTimeout       time.Duration
 }
 
-// Обработчик запроса на создание заказа. В нём мы декомпозируем входящий запрос на несколько сущностей
-// и добавляем их в базу данных.
-func (p *PostgresDatabase) CreateOrder(out chan interface{}, data []byte) {
-	defer close(out)
+// Закрытие пула соединений с Postgres
+func (p *PostgresDatabase) Close() error {
+	db, err := p.DatabaseConnection.DB()
+	if err != nil {
+		return err
+	}
+	if err = db.Close(); err != nil {
+		return err
+	}
+	p.Logger.Info("connection to postgres closed")
+	return nil
+}
 
-	newOrderFromJSON := &abstr.Order{}
-	queryResult := &abstr.QueryResult{
-		OrderSuccess:    0,
-		DeliverySuccess: 0,
-		PaymentSuccess:  0,
-		ItemsSuccess:    0,
-		Error:           nil,
-		IsSuccessQuery:  true,
+// Проверка доступности Postgres: пинг одного соединения из пула, не дольше QueryTimeout
+func (p *PostgresDatabase) Ping(ctx context.Context) error {
+	db, err := p.DatabaseConnection.DB()
+	if err != nil {
+		return err
 	}
+	ctx, cancel := p.withQueryTimeout(ctx)
+	defer cancel()
+	return db.PingContext(ctx)
+}
 
-	err := json.Unmarshal(data, newOrderFromJSON)
+// Создание заказа. Входящий заказ декомпозируется на несколько сущностей, которые добавляются в базу данных
+// одной транзакцией.
+// Запись идемпотентна по order_uid: повторный заказ с тем же содержимым ничего не меняет (возвращается
+// ErrDuplicate), а заказ с тем же order_uid, но другим содержимым, либо отклоняется с ErrConflict, либо записывается
+// новой версией (предыдущая сохраняется в order_versions) - в зависимости от ConflictPolicy. Остальные ошибки оборачиваются в StageError со стадией записи
+func (p *PostgresDatabase) Create(ctx context.Context, order *abstr.Order) error {
+	canonicalOrder, err := json.Marshal(order)
 	if err != nil {
-		queryResult.IsSuccessQuery = false
-		queryResult.Error = err
-		out <- queryResult
-		return
+		return &abstr.StageError{Stage: StageUnmarshal, Code: ErrOnUnmarshal, Err: err}
 	}
-	newDelivery := makeNewDelivery(newOrderFromJSON)
-	newPayment := makeNewPayment(newOrderFromJSON)
-	newItems, itemIDs := makeNewItems(newOrderFromJSON)
-	newOrder := makeNewOrderFromJSON(newOrderFromJSON, newDelivery.DeliveryID, newPayment.PaymentID, itemIDs)
+	contentHash := dbutils.HashContent(canonicalOrder)
 
-	result := p.DatabaseConnection.Table("deliveries").Create(newDelivery)
-	if result.Error != nil {
-		p.Logger.Warn("can't create new row in deliveries table")
-		queryResult.DeliverySuccess = ErrOnCreateRow
-		queryResult.Error = wrapError(queryResult.Error, result.Error,
-			"failed on creating new row in deliveries table")
-		queryResult.IsSuccessQuery = false
+	// Если параллельно пришёл такой же заказ и успел записаться первым, то мы упрёмся в первичный ключ
+	// по order_uid. В этом случае повторяем запись: со второй попытки заказ уже будет найден в базе
+	var version int
+	for attempt := 0; attempt < 2; attempt++ {
+		queryCtx, cancel := p.withQueryTimeout(ctx)
+		version, err = p.writeOrder(queryCtx, order, contentHash)
+		cancel()
+		if !errors.Is(err, errOrderUidTaken) {
+			break
+		}
 	}
-	result = p.DatabaseConnection.Table("payments").Create(newPayment)
-	if result.Error != nil {
-		p.Logger.Warn("can't create new row in payments table")
-		queryResult.PaymentSuccess = ErrOnCreateRow
-		queryResult.Error = wrapError(queryResult.Error, result.Error,
-			"failed on creating new row in payments table")
-		queryResult.IsSuccessQuery = false
+	logger := log.FromContext(ctx, p.Logger)
+	switch {
+	case err == nil:
+		logger.Infow("added order with payment, delivery and items", "order_uid", order.OrderUid,
+			"version", version)
+		return nil
+	case errors.Is(err, abstr.ErrDuplicate):
+		logger.Infow("order already exists with the same content, skipped", "order_uid", order.OrderUid)
+		return err
 	}
 
-	for _, item := range newItems {
-		result = p.DatabaseConnection.Table("items").Create(item)
+	stageErr := toStageError(err)
+	logger.Warnw("transaction rolled back", "order_uid", order.OrderUid, "stage", stageErr.Stage,
+		"error", stageErr.Err)
+	return stageErr
+}
+
+// Приведение ошибки записи заказа к StageError: ошибка без стадии считается ошибкой коммита транзакции.
+// Там же помечаем, временная ли ошибка
+func toStageError(err error) *abstr.StageError {
+	var stageErr *abstr.StageError
+	if !errors.As(err, &stageErr) {
+		stageErr = &abstr.StageError{Stage: StageCommit, Code: ErrOnCommitTx,
+			Err: wrapError(nil, err, "failed on committing transaction")}
+	}
+	stageErr.Transient = IsTransientError(stageErr.Err)
+	return stageErr
+}
+
+// Запись заказа в одной транзакции: при ошибке на любой стадии gorm откатывает транзакцию, и в базе
+// не остаётся "осиротевших" доставок, платежей и вещей. Строка существующего заказа блокируется на время
+// транзакции, чтобы две новые версии одного заказа не записались одновременно. Возвращает номер записанной версии
+func (p *PostgresDatabase) writeOrder(ctx context.Context, orderFromJSON *abstr.Order, contentHash string) (int, error) {
+	newDelivery := makeNewDelivery(orderFromJSON)
+	newPayment := makeNewPayment(orderFromJSON)
+	newItems := makeNewItems(orderFromJSON)
+	newOrder := makeNewOrderFromJSON(orderFromJSON)
+	newOrder.ContentHash = contentHash
+	newOrder.Version = 1
+
+	err := p.DatabaseConnection.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		existingOrder := &pg.Order{}
+		result := tx.Table("orders").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("order_uid = ?", orderFromJSON.OrderUid).Limit(1).Find(existingOrder)
 		if result.Error != nil {
-			p.Logger.Warn(
-				fmt.Sprintf("can't create new row in items table for item with ChrtId %v", item.ChrtId))
-			queryResult.ItemsSuccess = ErrOnCreateRow
-			queryResult.IsSuccessQuery = false
-			queryResult.Error = wrapError(queryResult.Error, result.Error,
-				fmt.Sprintf("can't create new row in items table for item with ChrtId %v", item.ChrtId))
+			return &abstr.StageError{Stage: StageLookup, Code: ErrOnFindRow,
+				Err: wrapError(nil, result.Error, "failed on looking up existing order")}
 		}
-	}
-	result = p.DatabaseConnection.Table("orders").Create(newOrder)
-	if result.Error != nil {
-		p.Logger.Warn("can't create new row in orders table")
-		queryResult.OrderSuccess = ErrOnCreateRow
-		queryResult.Error = wrapError(queryResult.Error, result.Error,
-			"failed on creating new row in orders table")
-		queryResult.IsSuccessQuery = false
-	}
-	p.Logger.Info("added new order with payment, delivery and items")
-	out <- queryResult
+		if result.RowsAffected > 0 {
+			if existingOrder.ContentHash == contentHash {
+				newOrder.Version = existingOrder.Version
+				return abstr.ErrDuplicate
+			}
+			if p.ConflictPolicy != ConflictPolicyVersion {
+				return &abstr.StageError{Stage: StageConflict, Code: ErrOnConflict,
+					Err: fmt.Errorf("order with order_uid %v: %w", orderFromJSON.OrderUid, abstr.ErrConflict)}
+			}
+			if err := p.archiveOrder(ctx, tx, existingOrder); err != nil {
+				return &abstr.StageError{Stage: StageConflict, Code: ErrOnCreateRow,
+					Err: wrapError(nil, err, "failed on saving previous version of order")}
+			}
+			if err := deleteOrderRows(tx, existingOrder); err != nil {
+				return &abstr.StageError{Stage: StageConflict, Code: ErrOnDeleteRow,
+					Err: wrapError(nil, err, "failed on removing previous version of order")}
+			}
+			newOrder.Version = existingOrder.Version + 1
+		}
+
+		// Сначала заказ: на него ссылаются внешние ключи остальных таблиц
+		result = tx.Table("orders").Omit(clause.Associations).Create(newOrder)
+		if result.Error != nil {
+			if isUniqueViolation(result.Error) {
+				return errOrderUidTaken
+			}
+			return &abstr.StageError{Stage: StageOrders, Code: ErrOnCreateRow,
+				Err: wrapError(nil, result.Error, "failed on creating new row in orders table")}
+		}
+		result = tx.Table("deliveries").Create(newDelivery)
+		if result.Error != nil {
+			return &abstr.StageError{Stage: StageDeliveries, Code: ErrOnCreateRow,
+				Err: wrapError(nil, result.Error, "failed on creating new row in deliveries table")}
+		}
+		result = tx.Table("payments").Create(newPayment)
+		if result.Error != nil {
+			return &abstr.StageError{Stage: StagePayments, Code: ErrOnCreateRow,
+				Err: wrapError(nil, result.Error, "failed on creating new row in payments table")}
+		}
+		if len(newItems) > 0 {
+			result = tx.Table("order_items").Create(newItems)
+			if result.Error != nil {
+				return &abstr.StageError{Stage: StageItems, Code: ErrOnCreateRow,
+					Err: wrapError(nil, result.Error, "failed on creating new rows in order_items table")}
+			}
+		}
+		return nil
+	})
+	return newOrder.Version, err
 }
 
-// Обработчик на получение заказа из БД. В нём мы "собираем" данные с сущностей постгреса в единый формат JSON,
-// который представлен в описании к заданию
-func (p *PostgresDatabase) GetOrder(out chan interface{}, data []byte) {
-	defer close(out)
+// Сохранение текущей версии заказа в order_versions перед её заменой (используется при ConflictPolicyVersion).
+// Заказ собирается в той же транзакции, в которой будет заменён
+func (p *PostgresDatabase) archiveOrder(ctx context.Context, tx *gorm.DB, order *pg.Order) error {
+	assembled, err := p.loadOrders(ctx, tx, []pg.Order{*order})
+	if err != nil {
+		return err
+	}
+	if len(assembled) == 0 {
+		return fmt.Errorf("order with order_uid %v has no delivery or payment", order.OrderUid)
+	}
+	content, err := json.Marshal(assembled[0])
+	if err != nil {
+		return err
+	}
+	return tx.Create(&pg.OrderVersion{
+		OrderUid:    order.OrderUid,
+		Version:     order.Version,
+		ContentHash: order.ContentHash,
+		Content:     string(content),
+	}).Error
+}
 
-	orderFromJSON := &abstr.Order{}
-	queryResult := &abstr.QueryResult{
-		OrderSuccess:    0,
-		DeliverySuccess: 0,
-		PaymentSuccess:  0,
-		ItemsSuccess:    0,
-		Error:           nil,
-		Data:            nil,
-		IsSuccessQuery:  true,
+// Удаление строк предыдущей версии заказа, уже сохранённой в order_versions (используется при ConflictPolicyVersion). Все удаления ограничены order_uid
+// заказа: chrt_id у вещей разных заказов может совпадать, поэтому по нему вещи не ищем. Доставка, платёж и вещи
+// удаляются и каскадно по внешним ключам, но явно удаляем их тоже, чтобы не зависеть от того,
+// с каким ON DELETE были созданы ключи
+func deleteOrderRows(tx *gorm.DB, order *pg.Order) error {
+	for _, model := range []interface{}{&pg.Item{}, &pg.Delivery{}, &pg.Payment{}, &pg.Order{}} {
+		if err := tx.Where("order_uid = ?", order.OrderUid).Delete(model).Error; err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err := json.Unmarshal(data, orderFromJSON)
+// Получение заказа из БД. В нём мы "собираем" данные с сущностей постгреса в единый формат JSON,
+// который представлен в описании к заданию. Если заказа нет, возвращается ErrNotFound
+func (p *PostgresDatabase) Get(ctx context.Context, orderUid string) (*abstr.Order, error) {
+	fetchedOrders, err := p.GetMany(ctx, []string{orderUid})
 	if err != nil {
-		queryResult.IsSuccessQuery = false
-		queryResult.Error = err
-		out <- queryResult
+		return nil, err
 	}
-	order := &pg.Order{}
-	result := p.DatabaseConnection.Table("orders").Where("order_uid = ?", orderFromJSON.OrderUid).First(
-		order)
-	if result.Error != nil {
-		p.Logger.Warn(fmt.Sprintf("can't find order with current order_uid: %v", orderFromJSON.OrderUid))
-		queryResult.OrderSuccess = ErrOnFindRow
-		queryResult.Error = wrapError(queryResult.Error, result.Error,
-			"failed on find row in orders table")
-		queryResult.IsSuccessQuery = false
-		out <- queryResult
-		return
-	}
-
-	delivery := &pg.Delivery{}
-	result = p.DatabaseConnection.Table("deliveries").Where("delivery_id = ?",
-		order.OrderDeliveryID).First(delivery)
-	if result.Error != nil {
-		p.Logger.Warn(fmt.Sprintf("can't find delivery with current order_delivery_id: %v",
-			order.OrderDeliveryID))
-		queryResult.DeliverySuccess = ErrOnFindRow
-		queryResult.Error = wrapError(queryResult.Error, result.Error,
-			"failed on find row in deliveries table")
-		queryResult.IsSuccessQuery = false
-		out <- queryResult
-	}
-	items := make([]*pg.Item, 0)
-	for _, itemID := range order.OrderItemsID {
-		item := &pg.Item{}
-		result = p.DatabaseConnection.Table("items").Where("chrt_id = ?", itemID).First(item)
+	if len(fetchedOrders) == 0 {
+		return nil, fmt.Errorf("order with order_uid %v: %w", orderUid, abstr.ErrNotFound)
+	}
+	return fetchedOrders[0], nil
+}
+
+// Получение сразу нескольких заказов, ненайденные пропускаются. Количество запросов в базу не зависит
+// от числа заказов в пачке
+func (p *PostgresDatabase) GetMany(ctx context.Context, orderUids []string) ([]*abstr.Order, error) {
+	ctx, cancel := p.withQueryTimeout(ctx)
+	defer cancel()
+
+	fetchedOrders := make([]*abstr.Order, 0, len(orderUids))
+	for start := 0; start < len(orderUids); start += assembleBatchSize {
+		batch := orderUids[start:min(start+assembleBatchSize, len(orderUids))]
+		var orders []pg.Order
+		result := p.DatabaseConnection.WithContext(ctx).Table("orders").Where("order_uid IN ?", batch).Find(&orders)
 		if result.Error != nil {
-			p.Logger.Warn(fmt.Sprintf("can't find item with chrt_id: %v", itemID))
-			queryResult.ItemsSuccess = ErrOnFindRow
-			queryResult.Error = wrapError(queryResult.Error, result.Error,
-				"failed on find row in items table")
-			queryResult.IsSuccessQuery = false
-		} else {
-			items = append(items, item)
+			log.FromContext(ctx, p.Logger).Warnw("failed on getting rows in table 'orders'",
+				"stage", StageOrders, "error", result.Error)
+			return nil, findError(StageOrders, wrapError(nil, result.Error, "failed on getting rows in orders table"))
+		}
+		assembled, err := p.loadOrders(ctx, p.DatabaseConnection.WithContext(ctx), orders)
+		if err != nil {
+			return nil, err
 		}
+		fetchedOrders = append(fetchedOrders, assembled...)
 	}
-	payment := &pg.Payment{}
-	result = p.DatabaseConnection.Table("payments").Where("payment_id = ?",
-		order.OrderPaymentID).First(payment)
+	return fetchedOrders, nil
+}
+
+// Метод для инкрементального обновления кэша: отдаёт заказы, записанные позже since (включая новые версии
+// при ConflictPolicyVersion), по возрастанию updated_at. Нулевой since - все заказы. Если limit > 0, то отдаются
+// только limit последних записанных заказов: при первой загрузке кэша нет смысла читать больше, чем в него
+// поместится. QueryTimeout здесь не применяется: заказов может быть очень много, так что время выборки
+// ограничивает только ctx вызывающего
+func (p *PostgresDatabase) ListUpdatedSince(ctx context.Context, since time.Time, limit int) (*abstr.OrdersChanges,
+	error) {
+	var changedOrders []pg.Order
+	query := p.DatabaseConnection.WithContext(ctx).Table("orders")
+	if !since.IsZero() {
+		query = query.Where("updated_at > ?", since)
+	}
+	if limit > 0 {
+		query = query.Order("updated_at DESC").Order("order_uid DESC").Limit(limit)
+	} else {
+		query = query.Order("updated_at").Order("order_uid")
+	}
+	result := query.Find(&changedOrders)
 	if result.Error != nil {
-		p.Logger.Warn(fmt.Sprintf("can't find item with chrt_id: %v", order.OrderPaymentID))
-		queryResult.PaymentSuccess = ErrOnFindRow
-		queryResult.Error = wrapError(queryResult.Error, result.Error,
-			"failed on find row in payments table")
-		queryResult.IsSuccessQuery = false
+		log.FromContext(ctx, p.Logger).Warnw("failed on getting changed rows in table 'orders'",
+			"stage", StageOrders, "error", result.Error)
+		return nil, findError(StageOrders,
+			wrapError(nil, result.Error, "failed on getting changed rows in orders table"))
+	}
+	if limit > 0 {
+		slices.Reverse(changedOrders)
 	}
 
-	orderData, err := convertOrderToJSON(order, delivery, payment, items)
+	// Если часть заказов не собралась, отдаём ошибку целиком: иначе watermark сдвинется за несобранные заказы,
+	// и следующее обновление кэша их уже не увидит
+	assembled, err := p.assembleOrders(ctx, changedOrders)
 	if err != nil {
-		p.Logger.Warn(fmt.Sprintf("marshaling to JSON order error: %v", err))
-		queryResult.Error = wrapError(queryResult.Error, err, "marshaling to JSON order error")
-		queryResult.Data = []byte("no data")
-		queryResult.IsSuccessQuery = false
-	}
-	queryResult.Data = orderData
-	queryResult.IsSuccessQuery = true
-	out <- queryResult
+		return nil, err
+	}
+	changes := &abstr.OrdersChanges{
+		Orders:    assembled,
+		Watermark: since,
+	}
+	for _, order := range changedOrders {
+		if order.UpdatedAt.After(changes.Watermark) {
+			changes.Watermark = order.UpdatedAt
+		}
+	}
+	return changes, nil
 }
 
-// Метод, используемый в главной управляющей структуре DataManager для того, чтобы список всех заказов с БД.
-// На выходе мы получаем слайс заказов, удовлетворяющих JSON из тех.задания, которые далее конвертируются в слайс байт
-// и дальше идут на обработчик добавления данных в кэш
-func (p *PostgresDatabase) GrepOrdersFromDatabase(out chan interface{}) {
-	defer close(out)
-	var allOrders []pg.Order
+// Получение страницы заказов. Применяем фильтры и keyset-пагинацию по паре (date_created, order_uid).
+// date_created - timestamptz, поэтому и фильтры, и сортировка, и курсор сравнивают моменты времени.
+// Из базы берём на одну запись больше лимита, чтобы понять, есть ли следующая страница
+func (p *PostgresDatabase) List(ctx context.Context, filter *abstr.OrdersFilter) (*abstr.OrdersPage, error) {
+	ctx, cancel := p.withQueryTimeout(ctx)
+	defer cancel()
 
-	queryResult := &abstr.QueryResult{
-		Error:          nil,
-		Data:           nil,
-		IsSuccessQuery: false,
+	query := p.DatabaseConnection.WithContext(ctx).Table("orders")
+	if filter.CustomerId != "" {
+		query = query.Where("customer_id = ?", filter.CustomerId)
+	}
+	if filter.TrackNumber != "" {
+		query = query.Where("track_number = ?", filter.TrackNumber)
+	}
+	if filter.DeliveryService != "" {
+		query = query.Where("delivery_service = ?", filter.DeliveryService)
+	}
+	if filter.Locale != "" {
+		query = query.Where("locale = ?", filter.Locale)
+	}
+	if filter.DateFrom != "" {
+		query = query.Where("date_created >= ?::timestamptz", filter.DateFrom)
+	}
+	if filter.DateTo != "" {
+		query = query.Where("date_created < ?::timestamptz", filter.DateTo)
+	}
+	// Заказы без даты (остались от старой схемы) идут в конце списка, пустая дата в курсоре означает такой заказ
+	if filter.AfterOrderUid != "" && filter.AfterDateCreated == "" {
+		query = query.Where("date_created IS NULL AND order_uid < ?", filter.AfterOrderUid)
+	} else if filter.AfterOrderUid != "" {
+		query = query.Where("((date_created, order_uid) < (?::timestamptz, ?) OR date_created IS NULL)",
+			filter.AfterDateCreated, filter.AfterOrderUid)
 	}
 
-	result := p.DatabaseConnection.Table("orders").Find(&allOrders)
+	var pageOrders []pg.Order
+	result := query.Order("date_created DESC NULLS LAST").Order("order_uid DESC").Limit(filter.Limit + 1).
+		Find(&pageOrders)
 	if result.Error != nil {
-		p.Logger.Warn(fmt.Sprintf("failed on getting all rows in table 'orders'"))
-		queryResult.Error = fmt.Errorf("failed on getting all rows in table 'orders': %v", result.Error)
-	}
-	fetchedOrders := make([]*abstr.Order, 0)
-	for _, val := range allOrders {
-		tempOrder := &abstr.Order{OrderUid: val.OrderUid}
-		data, _ := json.Marshal(tempOrder)
-		ch := make(chan interface{})
-		go p.GetOrder(ch, data)
-
-		orderFromDB := (<-ch).(*abstr.QueryResult)
-		if orderFromDB.IsSuccessQuery && orderFromDB.Data != nil {
-			tempOrder = &abstr.Order{}
-			_ = json.Unmarshal(orderFromDB.Data, tempOrder)
-			fetchedOrders = append(fetchedOrders, tempOrder)
-		}
+		log.FromContext(ctx, p.Logger).Warnw("failed on listing rows in table 'orders'",
+			"stage", StageOrders, "error", result.Error)
+		return nil, findError(StageOrders, wrapError(nil, result.Error, "failed on listing rows in orders table"))
+	}
+
+	page := &abstr.OrdersPage{}
+	if len(pageOrders) > filter.Limit {
+		page.HasMore = true
+		pageOrders = pageOrders[:filter.Limit]
 	}
-	convertedData, err := json.Marshal(fetchedOrders)
+	// Страница без части заказов сдвинула бы курсор за них, поэтому при ошибке сборки отдаём ошибку
+	assembled, err := p.assembleOrders(ctx, pageOrders)
 	if err != nil {
-		queryResult.IsSuccessQuery = false
-		queryResult.Error = fmt.Errorf("failed on marshaling orders from DB to []byte: %v", err)
+		return nil, err
+	}
+	page.Orders = assembled
+	return page, nil
+}
+
+// Сборка заказов из строк таблицы orders в формат JSON из тех.задания пачками по assembleBatchSize.
+// Если не удалось собрать хотя бы одну пачку, возвращается ошибка
+func (p *PostgresDatabase) assembleOrders(ctx context.Context, orders []pg.Order) ([]*abstr.Order, error) {
+	fetchedOrders := make([]*abstr.Order, 0, len(orders))
+	for start := 0; start < len(orders); start += assembleBatchSize {
+		batch := orders[start:min(start+assembleBatchSize, len(orders))]
+		assembled, err := p.loadOrders(ctx, p.DatabaseConnection.WithContext(ctx), batch)
+		if err != nil {
+			log.FromContext(ctx, p.Logger).Warnw("failed on assembling batch of orders", "count", len(batch),
+				"error", err)
+			return nil, err
+		}
+		fetchedOrders = append(fetchedOrders, assembled...)
 	}
-	queryResult.Data = convertedData
-	queryResult.IsSuccessQuery = true
-	out <- queryResult
+	return fetchedOrders, nil
+}
+
+// Загрузка доставок, платежей и вещей для пачки заказов. Вместо запросов на каждую строку делается по одному
+// запросу с IN на каждую таблицу, т.е. всегда три запроса. Заказы без доставки или платежа пропускаются.
+// Порядок заказов и вещей внутри заказа сохраняется. Запросы идут через db - соединение или транзакцию
+func (p *PostgresDatabase) loadOrders(ctx context.Context, db *gorm.DB, orders []pg.Order) ([]*abstr.Order, error) {
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	orderUids := make([]string, 0, len(orders))
+	for _, order := range orders {
+		orderUids = append(orderUids, order.OrderUid)
+	}
+
+	var deliveries []pg.Delivery
+	if err := db.Table("deliveries").Where("order_uid IN ?", orderUids).Find(&deliveries).Error; err != nil {
+		return nil, findError(StageDeliveries, wrapError(nil, err, "failed on find rows in deliveries table"))
+	}
+	var payments []pg.Payment
+	if err := db.Table("payments").Where("order_uid IN ?", orderUids).Find(&payments).Error; err != nil {
+		return nil, findError(StagePayments, wrapError(nil, err, "failed on find rows in payments table"))
+	}
+	var items []pg.Item
+	if err := db.Table("order_items").Where("order_uid IN ?", orderUids).
+		Order("order_uid").Order("position").Find(&items).Error; err != nil {
+		return nil, findError(StageItems, wrapError(nil, err, "failed on find rows in order_items table"))
+	}
+
+	deliveryByUid := make(map[string]pg.Delivery, len(deliveries))
+	for _, delivery := range deliveries {
+		deliveryByUid[delivery.OrderUid] = delivery
+	}
+	paymentByUid := make(map[string]pg.Payment, len(payments))
+	for _, payment := range payments {
+		paymentByUid[payment.OrderUid] = payment
+	}
+	itemsByUid := make(map[string][]pg.Item, len(orders))
+	for _, item := range items {
+		itemsByUid[item.OrderUid] = append(itemsByUid[item.OrderUid], item)
+	}
+
+	fetchedOrders := make([]*abstr.Order, 0, len(orders))
+	for i := range orders {
+		order := &orders[i]
+		delivery, hasDelivery := deliveryByUid[order.OrderUid]
+		payment, hasPayment := paymentByUid[order.OrderUid]
+		if !hasDelivery || !hasPayment {
+			log.FromContext(ctx, p.Logger).Warnw("can't find delivery or payment for order",
+				"order_uid", order.OrderUid)
+			continue
+		}
+		order.Delivery = delivery
+		order.Payment = payment
+		order.Items = itemsByUid[order.OrderUid]
+		fetchedOrders = append(fetchedOrders, convertOrder(order))
+	}
+	return fetchedOrders, nil
+}
+
+// Ограничение времени запроса в базу. Дедлайн ctx, если он раньше, сохраняется
+func (p *PostgresDatabase) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.QueryTimeout)
+}
+
+// Ошибка чтения из таблицы на стадии stage
+func findError(stage string, err error) error {
+	return &abstr.StageError{Stage: stage, Code: ErrOnFindRow, Transient: IsTransientError(err), Err: err}
 }
 
 // Далее идут вспомогательные функции, которые используются для декомпозии и "обратной сборки"
@@ -222,21 +488,21 @@ func (p *PostgresDatabase) GrepOrdersFromDatabase(out chan interface{}) {
 
 func makeNewDelivery(orderFromJSON *abstr.Order) *pg.Delivery {
 	newDelivery := &pg.Delivery{
-		DeliveryID: dbutils.GenerateNewID(),
-		Name:       orderFromJSON.Delivery.Name,
-		Phone:      orderFromJSON.Delivery.Phone,
-		Zip:        orderFromJSON.Delivery.Zip,
-		City:       orderFromJSON.Delivery.City,
-		Address:    orderFromJSON.Delivery.Address,
-		Region:     orderFromJSON.Delivery.Region,
-		Email:      orderFromJSON.Delivery.Email,
+		OrderUid: orderFromJSON.OrderUid,
+		Name:     orderFromJSON.Delivery.Name,
+		Phone:    orderFromJSON.Delivery.Phone,
+		Zip:      orderFromJSON.Delivery.Zip,
+		City:     orderFromJSON.Delivery.City,
+		Address:  orderFromJSON.Delivery.Address,
+		Region:   orderFromJSON.Delivery.Region,
+		Email:    orderFromJSON.Delivery.Email,
 	}
 	return newDelivery
 }
 
 func makeNewPayment(orderFromJSON *abstr.Order) *pg.Payment {
 	newPayment := &pg.Payment{
-		PaymentID:    dbutils.GenerateNewID(),
+		OrderUid:     orderFromJSON.OrderUid,
 		Transaction:  orderFromJSON.Payment.Transaction,
 		RequestId:    orderFromJSON.Payment.RequestId,
 		Currency:     orderFromJSON.Payment.Currency,
@@ -251,11 +517,12 @@ func makeNewPayment(orderFromJSON *abstr.Order) *pg.Payment {
 	return newPayment
 }
 
-func makeNewItems(orderFromJSON *abstr.Order) ([]*pg.Item, []string) {
-	newItems := make([]*pg.Item, 0)
-	itemIDs := make([]string, 0)
-	for _, itemFromOrder := range orderFromJSON.Items {
+func makeNewItems(orderFromJSON *abstr.Order) []*pg.Item {
+	newItems := make([]*pg.Item, 0, len(orderFromJSON.Items))
+	for position, itemFromOrder := range orderFromJSON.Items {
 		newItem := &pg.Item{
+			OrderUid:    orderFromJSON.OrderUid,
+			Position:    position,
 			ChrtId:      itemFromOrder.ChrtId,
 			TrackNumber: itemFromOrder.TrackNumber,
 			Price:       itemFromOrder.Price,
@@ -269,32 +536,31 @@ func makeNewItems(orderFromJSON *abstr.Order) ([]*pg.Item, []string) {
 			Status:      itemFromOrder.Status,
 		}
 		newItems = append(newItems, newItem)
-		itemIDs = append(itemIDs, strconv.Itoa(newItem.ChrtId))
 	}
-	return newItems, itemIDs
+	return newItems
 }
 
-func makeNewOrderFromJSON(orderFromJSON *abstr.Order, deliveryID string, paymentID string, itemsID []string) *pg.Order {
+// Дата создания, которая не разбирается (валидация такое не пропускает), записывается как нулевое время
+func makeNewOrderFromJSON(orderFromJSON *abstr.Order) *pg.Order {
+	dateCreated, _ := abstr.ParseTimestamp(orderFromJSON.DateCreated)
 	newOrder := &pg.Order{
 		OrderUid:          orderFromJSON.OrderUid,
 		TrackNumber:       orderFromJSON.TrackNumber,
 		Entry:             orderFromJSON.Entry,
-		OrderDeliveryID:   deliveryID,
-		OrderPaymentID:    paymentID,
-		OrderItemsID:      pq.StringArray(itemsID),
 		Locale:            orderFromJSON.Locale,
 		InternalSignature: orderFromJSON.InternalSignature,
 		CustomerId:        orderFromJSON.CustomerId,
 		DeliveryService:   orderFromJSON.DeliveryService,
 		Shardkey:          orderFromJSON.Shardkey,
 		SmId:              orderFromJSON.SmId,
-		DateCreated:       orderFromJSON.DateCreated,
+		DateCreated:       dateCreated,
 		OofShard:          orderFromJSON.OofShard,
 	}
 	return newOrder
 }
 
-func convertOrderToJSON(order *pg.Order, delivery *pg.Delivery, payment *pg.Payment, items []*pg.Item) ([]byte, error) {
+func convertOrder(order *pg.Order) *abstr.Order {
+	delivery, payment := &order.Delivery, &order.Payment
 	orderToJSON := &abstr.Order{
 		OrderUid:    order.OrderUid,
 		TrackNumber: order.TrackNumber,
@@ -364,11 +630,11 @@ func convertOrderToJSON(order *pg.Order, delivery *pg.Delivery, payment *pg.Paym
 		DeliveryService:   order.DeliveryService,
 		Shardkey:          order.Shardkey,
 		SmId:              order.SmId,
-		DateCreated:       order.DateCreated,
+		DateCreated:       abstr.FormatTimestamp(order.DateCreated),
 		OofShard:          order.OofShard,
 	}
 
-	for _, item := range items {
+	for _, item := range order.Items {
 		itemConverted := struct {
 			ChrtId      int    `json:"chrt_id"`
 			TrackNumber string `json:"track_number"`
@@ -396,17 +662,50 @@ func convertOrderToJSON(order *pg.Order, delivery *pg.Delivery, payment *pg.Paym
 		}
 		orderToJSON.Items = append(orderToJSON.Items, itemConverted)
 	}
-	data, err := json.Marshal(orderToJSON)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling error: %v", err)
+	return orderToJSON
+}
+
+// Проверка, что ошибка - нарушение уникального индекса
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+// Проверка, что ошибка временная и запрос имеет смысл повторить: Postgres недоступен, соединение оборвалось,
+// транзакция упала на дедлоке или конфликте сериализации. Ошибки данных (нарушение ограничений, неверный JSON)
+// временными не считаются
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case serializationFailureCode, deadlockDetectedCode, tooManyConnectionsCode,
+			adminShutdownCode, crashShutdownCode, cannotConnectNowCode:
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, connectionExceptionClass)
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
 	}
-	return data, nil
+	return pgconn.SafeToRetry(err)
 }
 
 // Функция для обёртки ошибок (нужна для того, чтобы оборачивать ошибки, когда мы работаем с несколькими таблицами)
 func wrapError(oldErr error, newErr error, newErrMessage string) error {
 	if oldErr != nil {
-		return fmt.Errorf("%s: %v | %v", newErrMessage, newErr, oldErr)
+		return fmt.Errorf("%s: %w | %w", newErrMessage, newErr, oldErr)
 	}
-	return fmt.Errorf("%v: %v", newErrMessage, newErr)
+	return fmt.Errorf("%v: %w", newErrMessage, newErr)
 }
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"go.uber.org/zap"
+)
+
+// Композитный репозиторий заказов: чтение сначала из кэша, а при промахе - из основного хранилища
+// с добавлением найденного заказа в кэш. Запись идёт в хранилище, а после успеха - в кэш.
+// Списки заказов всегда берутся из хранилища, так как кэш не умеет фильтровать и сортировать заказы
+type ReadThroughRepository struct {
+	Cache  handlers.OrderRepository
+	Store  handlers.OrderRepository
+	Logger *zap.SugaredLogger
+}
+
+// Запись заказа. Если такой же заказ уже был записан (ErrDuplicate), то кэш не трогаем
+func (r *ReadThroughRepository) Create(ctx context.Context, order *handlers.Order) error {
+	if err := r.Store.Create(ctx, order); err != nil {
+		return err
+	}
+	if err := r.Cache.Create(ctx, order); err != nil {
+		log.FromContext(ctx, r.Logger).Warnw("failed in save order in cache", "order_uid", order.OrderUid, "error", err)
+	}
+	return nil
+}
+
+func (r *ReadThroughRepository) Get(ctx context.Context, orderUid string) (*handlers.Order, error) {
+	logger := log.FromContext(ctx, r.Logger)
+	order, err := r.Cache.Get(ctx, orderUid)
+	if err == nil {
+		logger.Infow("got order from cache", "order_uid", orderUid)
+		return order, nil
+	}
+	if !errors.Is(err, handlers.ErrNotFound) {
+		logger.Warnw("failed to get order from cache", "order_uid", orderUid, "error", err)
+	}
+
+	order, err = r.Store.Get(ctx, orderUid)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Cache.Create(ctx, order); err != nil {
+		logger.Warnw("failed in save order in cache", "order_uid", orderUid, "error", err)
+	}
+	return order, nil
+}
+
+// Получение нескольких заказов: найденные в кэше заказы берутся из него, остальные одним пакетным запросом
+// достаются из хранилища и добавляются в кэш. Порядок заказов в ответе не гарантируется
+func (r *ReadThroughRepository) GetMany(ctx context.Context, orderUids []string) ([]*handlers.Order, error) {
+	fetchedOrders, err := r.Cache.GetMany(ctx, orderUids)
+	if err != nil {
+		return nil, err
+	}
+	if len(fetchedOrders) == len(orderUids) {
+		return fetchedOrders, nil
+	}
+
+	isCached := make(map[string]bool, len(fetchedOrders))
+	for _, order := range fetchedOrders {
+		isCached[order.OrderUid] = true
+	}
+	missedUids := make([]string, 0, len(orderUids)-len(fetchedOrders))
+	for _, orderUid := range orderUids {
+		if !isCached[orderUid] {
+			missedUids = append(missedUids, orderUid)
+		}
+	}
+
+	missedOrders, err := r.Store.GetMany(ctx, missedUids)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.FromContext(ctx, r.Logger)
+	for _, order := range missedOrders {
+		if err = r.Cache.Create(ctx, order); err != nil {
+			logger.Warnw("failed in save order in cache", "order_uid", order.OrderUid, "error", err)
+		}
+	}
+	logger.Infow("got orders", "found", len(fetchedOrders)+len(missedOrders), "requested", len(orderUids),
+		"from_cache", len(fetchedOrders))
+	return append(fetchedOrders, missedOrders...), nil
+}
+
+func (r *ReadThroughRepository) List(ctx context.Context, filter *handlers.OrdersFilter) (*handlers.OrdersPage, error) {
+	return r.Store.List(ctx, filter)
+}
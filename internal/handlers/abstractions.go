@@ -1,5 +1,7 @@
 package handlers
 
+import "time"
+
 // Структура со входящим JSON, которую мы в дальнейшем декомпозируем
 type Order struct {
 	OrderUid    string `json:"order_uid"`
@@ -49,24 +51,30 @@ type Order struct {
 	OofShard          string `json:"oof_shard"`
 }
 
-// Структура, которая используется в модуле работы с Postgres.
-// Ключевые поля этой структуры - IsSuccessQuery и Data.
-// По булевому значению поля мы в дальнейшем проверяем, был ли успешен запрос. Если он не увенчался успехом,
-// То обрабатываем ошибку из поля Error
-type QueryResult struct {
-	OrderSuccess    int
-	DeliverySuccess int
-	PaymentSuccess  int
-	ItemsSuccess    int
-	Error           error
-	Data            []byte
-	IsSuccessQuery  bool
+// Фильтр для постраничного получения списка заказов. Заказы сортируются от новых к старым по паре
+// (date_created, order_uid), поля After* - позиция последнего заказа с предыдущей страницы (курсор)
+type OrdersFilter struct {
+	CustomerId       string `json:"customer_id"`
+	TrackNumber      string `json:"track_number"`
+	DeliveryService  string `json:"delivery_service"`
+	Locale           string `json:"locale"`
+	DateFrom         string `json:"date_from"`
+	DateTo           string `json:"date_to"`
+	AfterDateCreated string `json:"after_date_created"`
+	AfterOrderUid    string `json:"after_order_uid"`
+	Limit            int    `json:"limit"`
+}
+
+// Страница со списком заказов. HasMore говорит о том, что за последним заказом страницы есть ещё заказы
+type OrdersPage struct {
+	Orders     []*Order `json:"orders"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+	HasMore    bool     `json:"has_more"`
 }
 
-// Аналогичная структура, но которая использутся в модуле работы с in memory кэшированием.
-// Логика работы аналогичная
-type CacheQueryResult struct {
-	Data           []byte
-	Message        string
-	IsSuccessQuery bool
+// Заказы, записанные после отметки Since. Watermark - наибольшее время записи среди них, с него начинается
+// следующее обновление кэша
+type OrdersChanges struct {
+	Orders    []*Order  `json:"orders"`
+	Watermark time.Time `json:"watermark"`
 }
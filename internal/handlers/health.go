@@ -0,0 +1,9 @@
+package handlers
+
+// Состояние компонента сервиса для проверки готовности (readiness): Postgres, получатель кафки, кэш и т.д.
+// Detail - причина, по которой компонент не готов (или пояснение к состоянию)
+type ComponentStatus struct {
+	Name   string `json:"name"`
+	Ready  bool   `json:"ready"`
+	Detail string `json:"detail,omitempty"`
+}
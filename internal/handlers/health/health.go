@@ -0,0 +1,72 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"go.uber.org/zap"
+	"net/http"
+	"sync/atomic"
+)
+
+// Источник состояния компонентов для проверки готовности, его реализует DataManager
+type ReadinessChecker interface {
+	Readiness(ctx context.Context) []handlers.ComponentStatus
+}
+
+// Обработчики проверок для Kubernetes: /healthz (процесс жив) и /readyz (сервис готов принимать запросы).
+// После Drain сервис считается неготовым, чтобы балансировщик перестал слать ему запросы до остановки
+type HealthHandler struct {
+	Logger   *zap.SugaredLogger
+	Checker  ReadinessChecker
+	draining atomic.Bool
+}
+
+// Ответ проверки: общий статус и состояние компонентов (для /healthz компонентов нет)
+type Report struct {
+	Status     string                     `json:"status"`
+	Components []handlers.ComponentStatus `json:"components,omitempty"`
+}
+
+// Перевод сервиса в неготовое состояние перед остановкой
+func (h *HealthHandler) Drain() {
+	h.draining.Store(true)
+}
+
+// Обработчик GET /healthz. Отвечает 200, пока процесс может обрабатывать HTTP-запросы, состояние зависимостей
+// не проверяется - иначе недоступность Postgres приводила бы к перезапуску всех подов
+func (h *HealthHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, &Report{Status: "ok"})
+}
+
+// Обработчик GET /readyz. Отвечает 200, если готовы все компоненты, иначе 503. В теле - состояние каждого
+// компонента, так что по ответу видно, чего именно не хватает
+func (h *HealthHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	components := h.Checker.Readiness(r.Context())
+	server := handlers.ComponentStatus{Name: "server", Ready: !h.draining.Load()}
+	if !server.Ready {
+		server.Detail = "server is shutting down"
+	}
+	components = append(components, server)
+
+	report := &Report{Status: "ready", Components: components}
+	code := http.StatusOK
+	for _, component := range components {
+		if !component.Ready {
+			report.Status = "not ready"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+	if code != http.StatusOK {
+		h.Logger.Debugw("service is not ready", "components", components)
+	}
+	writeReport(w, code, report)
+}
+
+func writeReport(w http.ResponseWriter, code int, report *Report) {
+	data, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
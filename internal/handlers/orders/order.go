@@ -1,38 +1,70 @@
 package orders
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/nehachuha1/wbtech-tasks/internal/database"
 	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
 	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"github.com/nehachuha1/wbtech-tasks/pkg/retry"
 	"go.uber.org/zap"
 	"html/template"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ограничения на размер страницы при получении списка заказов
+const (
+	defaultOrdersLimit = 20
+	maxOrdersLimit     = 100
 )
 
 type OrderHandler struct {
 	Templates     *template.Template
 	Logger        *zap.SugaredLogger
-	DataManager   *database.DataManager
-	KafkaProducer *producer.KafkaProducer
+	Orders        handlers.OrderRepository
+	KafkaProducer producer.OrderProducer
+	RetryPolicy   retry.Policy
 }
 
-// Обработчик запроса на создание заказа. Если запрос успешно маршалится в структуру нового заказа, то
-// мы пушим тело запроса в очередь топика orders и отдаём JSON о том, что запрос успешен.
+// Обработчик запроса на создание заказа. Если запрос успешно маршалится в структуру нового заказа и проходит
+// валидацию (иначе отдаём 422 со списком ошибок по полям), то мы пушим тело запроса в очередь топика orders
+// (временные ошибки брокера повторяем по политике повторов) и отдаём JSON о том, что запрос успешен.
+// Если кафка так и осталась недоступна, то заказ сохраняется в локальный outbox и мы отдаём 202, а если outbox
+// выключен (DeferToOutbox вернул ошибку) - статус по типу ошибки продюсера (см. producerErrorStatus)
 func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Wrong method", http.StatusBadRequest)
 		return
 	}
 	data, err := ParseBodyToOrder(r)
+	var validationErrs handlers.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		writeValidationErrors(w, validationErrs)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = h.KafkaProducer.PushOrderToQueue(data)
+	_, err = h.RetryPolicy.Do(r.Context(), func() error {
+		return h.KafkaProducer.PushOrderToQueue(r.Context(), data)
+	}, producer.IsTransientError)
+	if err != nil && producer.IsTransientError(err) {
+		if outboxErr := h.KafkaProducer.DeferToOutbox(data); outboxErr == nil {
+			writeJSONMessage(w, http.StatusAccepted, "order accepted, it will be sent to queue when kafka is available")
+			return
+		}
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeJSONMessage(w, producerErrorStatus(err), err.Error())
+		return
 	}
 
 	result := struct {
@@ -62,17 +94,10 @@ func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("error by unmarshaling: %v", err), http.StatusBadRequest)
 		return
 	}
-	data, err := json.Marshal(order)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error by marshaling: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	out := make(chan []byte)
-	go h.DataManager.RunQuery("getOrder", data, out)
-	result := <-out
-	if result != nil {
-		w.Write(result)
+	result, err := h.Orders.Get(r.Context(), order.OrderUid)
+	if err == nil {
+		data, _ := json.Marshal(result)
+		w.Write(data)
 		return
 	}
 	message := struct {
@@ -82,7 +107,68 @@ func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
 		Code:    400,
 		Message: "can't find order with this order_uid",
 	}
-	data, _ = json.Marshal(message)
+	data, _ := json.Marshal(message)
+	w.Write(data)
+}
+
+// Обработчик GET /orders/{order_uid}. В отличие от GetOrder не требует тела запроса - order_uid берётся из пути.
+// Если заказ не найден ни в кэше, ни в Postgres, то отдаём 404, иначе 200 и JSON заказа
+func (h *OrderHandler) GetOrderByUID(w http.ResponseWriter, r *http.Request) {
+	orderUID := mux.Vars(r)["order_uid"]
+	if orderUID == "" {
+		writeJSONMessage(w, http.StatusBadRequest, "order_uid is required")
+		return
+	}
+
+	order, err := h.Orders.Get(r.Context(), orderUID)
+	if errors.Is(err, handlers.ErrNotFound) {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("can't find order with order_uid %v", orderUID))
+		return
+	}
+	if err != nil {
+		log.FromContext(r.Context(), h.Logger).Warnw("failed on getting order", "order_uid", orderUID, "error", err)
+		writeJSONMessage(w, repositoryErrorStatus(err), fmt.Sprintf("can't get order with order_uid %v", orderUID))
+		return
+	}
+
+	data, err := json.Marshal(order)
+	if err != nil {
+		writeJSONMessage(w, http.StatusInternalServerError, fmt.Sprintf("error by marshaling: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Обработчик GET /orders. Отдаёт страницу заказов от новых к старым. Поддерживаются фильтры customer_id,
+// track_number, delivery_service, locale, диапазон date_from/date_to (RFC3339, date_to не включительно),
+// а также limit и cursor. Курсор на следующую страницу возвращается в поле next_cursor
+func (h *OrderHandler) ListOrders(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseOrdersFilter(r)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := h.Orders.List(r.Context(), filter)
+	if err != nil {
+		log.FromContext(r.Context(), h.Logger).Warnw("failed on listing orders", "error", err)
+		writeJSONMessage(w, repositoryErrorStatus(err), "can't get list of orders")
+		return
+	}
+	if page.HasMore && len(page.Orders) > 0 {
+		lastOrder := page.Orders[len(page.Orders)-1]
+		page.NextCursor = encodeCursor(lastOrder.DateCreated, lastOrder.OrderUid)
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		writeJSONMessage(w, http.StatusInternalServerError, fmt.Sprintf("error by marshaling: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
@@ -95,13 +181,17 @@ func (h *OrderHandler) Index(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Вспомогательная функция для того, чтобы маршалить запрос в структуру Order.
+// Вспомогательная функция для того, чтобы маршалить запрос в структуру Order. Если заказ не проходит валидацию,
+// то возвращается ошибка handlers.ValidationErrors
 func ParseBodyToOrder(r *http.Request) ([]byte, error) {
 	order := new(handlers.Order)
 
 	if err := json.NewDecoder(r.Body).Decode(order); err != nil {
 		return nil, err
 	}
+	if validationErrs := order.Validate(); validationErrs != nil {
+		return nil, validationErrs
+	}
 
 	orderInBytes, err := json.Marshal(order)
 	if err != nil {
@@ -109,3 +199,124 @@ func ParseBodyToOrder(r *http.Request) ([]byte, error) {
 	}
 	return orderInBytes, nil
 }
+
+// Вспомогательная функция для ответа JSON-сообщением в том же формате, что и остальные обработчики
+func writeJSONMessage(w http.ResponseWriter, code int, message string) {
+	result := struct {
+		Code    int
+		Message string
+	}{
+		Code:    code,
+		Message: message,
+	}
+
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// Вспомогательная функция для разбора query-параметров запроса на список заказов в фильтр
+func parseOrdersFilter(r *http.Request) (*handlers.OrdersFilter, error) {
+	query := r.URL.Query()
+	filter := &handlers.OrdersFilter{
+		CustomerId:      query.Get("customer_id"),
+		TrackNumber:     query.Get("track_number"),
+		DeliveryService: query.Get("delivery_service"),
+		Locale:          query.Get("locale"),
+		Limit:           defaultOrdersLimit,
+	}
+
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 || limit > maxOrdersLimit {
+			return nil, fmt.Errorf("limit must be an integer between 1 and %v", maxOrdersLimit)
+		}
+		filter.Limit = limit
+	}
+
+	for param, field := range map[string]*string{"date_from": &filter.DateFrom, "date_to": &filter.DateTo} {
+		rawDate := query.Get(param)
+		if rawDate == "" {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, rawDate)
+		if err != nil {
+			return nil, fmt.Errorf("%v must be in RFC3339 format: %v", param, err)
+		}
+		*field = date.Format(time.RFC3339Nano)
+	}
+
+	if rawCursor := query.Get("cursor"); rawCursor != "" {
+		dateCreated, orderUID, err := decodeCursor(rawCursor)
+		if err != nil {
+			return nil, err
+		}
+		filter.AfterDateCreated = dateCreated
+		filter.AfterOrderUid = orderUID
+	}
+	return filter, nil
+}
+
+// Курсор - это base64 от пары date_created и order_uid последнего заказа на странице. Дата в курсоре проверяется,
+// чтобы испорченный курсор давал 400, а не ошибку запроса к базе
+func encodeCursor(dateCreated string, orderUID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(dateCreated + "|" + orderUID))
+}
+
+func decodeCursor(cursor string) (string, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", errors.New("invalid cursor")
+	}
+	dateCreated, orderUID, isFound := strings.Cut(string(raw), "|")
+	if !isFound || orderUID == "" {
+		return "", "", errors.New("invalid cursor")
+	}
+	// Пустая дата - у последнего заказа страницы не было даты создания
+	if _, err = handlers.ParseTimestamp(dateCreated); dateCreated != "" && err != nil {
+		return "", "", errors.New("invalid cursor")
+	}
+	return dateCreated, orderUID, nil
+}
+
+// Ответ 422 со списком ошибок валидации заказа
+func writeValidationErrors(w http.ResponseWriter, validationErrs handlers.ValidationErrors) {
+	result := struct {
+		Code    int
+		Message string
+		Errors  handlers.ValidationErrors
+	}{
+		Code:    http.StatusUnprocessableEntity,
+		Message: "order validation failed",
+		Errors:  validationErrs,
+	}
+
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(data)
+}
+
+// HTTP-статус по типу ошибки продюсера: сообщение слишком большое - 413, брокер недоступен - 503,
+// таймаут - 504, остальные ошибки - 502
+func producerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, producer.ErrMessageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, producer.ErrBrokerUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, producer.ErrTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// HTTP-статус по ошибке репозитория: сервис останавливается или ошибка временная - 503, остальные - 500
+func repositoryErrorStatus(err error) int {
+	if errors.Is(err, database.ErrShuttingDown) || handlers.IsTransient(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,146 @@
+package orders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database"
+	pg "github.com/nehachuha1/wbtech-tasks/internal/database/postgres"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/testutil"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Роутер с обработчиками заказов поверх менеджера данных с хранилищем в памяти
+func newTestRouter(t *testing.T, store *pg.MemoryDatabase) *mux.Router {
+	t.Helper()
+	logger := zap.NewNop().Sugar()
+	dataManager := database.NewDataManagerWithStore(store,
+		&config.CacheConfig{ClearInterval: time.Hour, CacheLimit: 100, EvictionPolicy: "lru"},
+		&config.RetryConfig{MaxAttempts: 1}, logger)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		dataManager.Shutdown(ctx)
+	})
+
+	ordersHandler := &OrderHandler{Logger: logger, Orders: dataManager}
+	r := mux.NewRouter()
+	r.HandleFunc("/get", ordersHandler.GetOrder).Methods("POST")
+	r.HandleFunc("/orders", ordersHandler.ListOrders).Methods("GET")
+	r.HandleFunc("/orders/{order_uid}", ordersHandler.GetOrderByUID).Methods("GET")
+	return r
+}
+
+func serve(r http.Handler, method string, target string, body []byte) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(method, target, bytes.NewReader(body)))
+	return recorder
+}
+
+func TestGetOrderByUID(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	order := testutil.Order(t, "b563feb7b2b84b6test", testutil.DateCreated)
+	if err := store.Create(context.Background(), order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	r := newTestRouter(t, store)
+
+	response := serve(r, http.MethodGet, "/orders/b563feb7b2b84b6test", nil)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %s", response.Code, response.Body)
+	}
+	expected, _ := json.Marshal(order)
+	if response.Body.String() != string(expected) {
+		t.Fatalf("unexpected order:\nexpected %s\nactual   %s", expected, response.Body)
+	}
+
+	if response = serve(r, http.MethodGet, "/orders/missing", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %v: %s", response.Code, response.Body)
+	}
+}
+
+func TestGetOrderByUIDStoreUnavailable(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	r := newTestRouter(t, store)
+
+	store.FailOn(pg.OpRead, pg.StageOrders, &pgconn.PgError{Code: "57P03"}, 1)
+	if response := serve(r, http.MethodGet, "/orders/any", nil); response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 on transient error, got %v: %s", response.Code, response.Body)
+	}
+	if err := store.Create(context.Background(), testutil.Order(t, "broken", testutil.DateCreated)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	store.FailOn(pg.OpRead, pg.StageItems, fmt.Errorf("column does not exist"), 1)
+	if response := serve(r, http.MethodGet, "/orders/broken", nil); response.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 on permanent error, got %v: %s", response.Code, response.Body)
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	order := testutil.Order(t, "posted", testutil.DateCreated)
+	if err := store.Create(context.Background(), order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	r := newTestRouter(t, store)
+
+	response := serve(r, http.MethodPost, "/get", []byte(`{"order_uid": "posted"}`))
+	fetched := &handlers.Order{}
+	if err := json.Unmarshal(response.Body.Bytes(), fetched); err != nil || fetched.OrderUid != "posted" {
+		t.Fatalf("unexpected response %v: %s", response.Code, response.Body)
+	}
+	if response = serve(r, http.MethodPost, "/get", []byte(`not json`)); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", response.Code)
+	}
+}
+
+func TestListOrdersPagination(t *testing.T) {
+	store := pg.NewMemoryDatabase(pg.ConflictPolicyReject, zap.NewNop().Sugar())
+	for idx, orderUid := range []string{"a", "b", "c"} {
+		dateCreated := fmt.Sprintf("2021-11-2%vT06:22:19Z", idx)
+		if err := store.Create(context.Background(), testutil.Order(t, orderUid, dateCreated)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	r := newTestRouter(t, store)
+
+	var listed []string
+	target := "/orders?limit=2"
+	for {
+		response := serve(r, http.MethodGet, target, nil)
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %v: %s", response.Code, response.Body)
+		}
+		page := &handlers.OrdersPage{}
+		if err := json.Unmarshal(response.Body.Bytes(), page); err != nil {
+			t.Fatalf("unmarshal page: %v", err)
+		}
+		for _, order := range page.Orders {
+			listed = append(listed, order.OrderUid)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		target = "/orders?limit=2&cursor=" + page.NextCursor
+	}
+	if fmt.Sprint(listed) != "[c b a]" {
+		t.Fatalf("unexpected orders: %v", listed)
+	}
+
+	// Курсор без разделителя - base64 от "not-a-cursor"
+	badTargets := []string{"/orders?limit=0", "/orders?date_from=yesterday", "/orders?cursor=bm90LWEtY3Vyc29y"}
+	for _, target := range badTargets {
+		if response := serve(r, http.MethodGet, target, nil); response.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %v", target, response.Code)
+		}
+	}
+}
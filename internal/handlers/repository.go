@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Ошибки репозитория заказов. Реализации оборачивают их, поэтому проверять нужно через errors.Is
+var (
+	ErrNotFound  = errors.New("order not found")
+	ErrDuplicate = errors.New("order already exists with the same content")
+	ErrConflict  = errors.New("order already exists with different content")
+)
+
+// Типизированный доступ к заказам. Реализуется Postgres'ом, кэшем и композитным репозиторием, который читает
+// из кэша, а при промахе идёт в Postgres.
+// Create возвращает ErrDuplicate, если такой же заказ уже записан (запись при этом ничего не меняет),
+// и ErrConflict, если заказ с таким order_uid записан с другим содержимым.
+// Get возвращает ErrNotFound, если заказа нет. GetMany пропускает ненайденные заказы
+type OrderRepository interface {
+	Create(ctx context.Context, order *Order) error
+	Get(ctx context.Context, orderUid string) (*Order, error)
+	GetMany(ctx context.Context, orderUids []string) ([]*Order, error)
+	List(ctx context.Context, filter *OrdersFilter) (*OrdersPage, error)
+}
+
+// Ошибка с информацией о том, на какой стадии обработки заказа она произошла (например, "payments"),
+// с кодом ошибки и признаком того, что ошибка временная и запрос можно повторить
+type StageError struct {
+	Stage     string
+	Code      int
+	Transient bool
+	Err       error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %v: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Проверка, что ошибку можно повторить: такие ошибки помечаются через StageError
+func IsTransient(err error) bool {
+	var stageErr *StageError
+	return errors.As(err, &stageErr) && stageErr.Transient
+}
+
+// Отчёт об ошибке в виде, пригодном для JSON и заголовков dead-letter сообщений
+type QueryFailure struct {
+	Stage     string `json:"stage"`
+	Code      int    `json:"code"`
+	Error     string `json:"error"`
+	Transient bool   `json:"transient"`
+}
+
+// Отчёт об ошибке. Стадия, код и признак временной ошибки берутся из StageError, если он есть в цепочке
+func FailureFromError(err error) *QueryFailure {
+	failure := &QueryFailure{Stage: "unknown", Error: err.Error()}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		failure.Stage = stageErr.Stage
+		failure.Code = stageErr.Code
+		failure.Transient = stageErr.Transient
+	}
+	return failure
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Стадия обработки заказа, на которой он не прошёл валидацию (используется в QueryFailure)
+const StageValidation = "validation"
+
+// Ошибка валидации конкретного поля заказа. Pointer - JSON pointer (RFC 6901) на поле, например /items/0/price
+type FieldError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// Список ошибок валидации заказа
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, fieldErr := range v {
+		messages = append(messages, fmt.Sprintf("%v: %v", fieldErr.Pointer, fieldErr.Message))
+	}
+	return "order validation failed: " + strings.Join(messages, "; ")
+}
+
+// Валидация заказа перед тем, как он попадёт в очередь или в базу. Кроме обязательных полей и неотрицательных сумм
+// проверяются инварианты заказа: все вещи относятся к тому же track_number, goods_total равен сумме total_price
+// вещей, а amount = goods_total + delivery_cost + custom_fee. Если ошибок нет, то возвращается nil
+func (o *Order) Validate() ValidationErrors {
+	var errs ValidationErrors
+	addErr := func(pointer string, message string) {
+		errs = append(errs, FieldError{Pointer: pointer, Message: message})
+	}
+	required := func(pointer string, value string) {
+		if strings.TrimSpace(value) == "" {
+			addErr(pointer, "is required")
+		}
+	}
+	nonNegative := func(pointer string, value int) {
+		if value < 0 {
+			addErr(pointer, "must not be negative")
+		}
+	}
+
+	required("/order_uid", o.OrderUid)
+	required("/track_number", o.TrackNumber)
+	required("/entry", o.Entry)
+	required("/customer_id", o.CustomerId)
+	nonNegative("/sm_id", o.SmId)
+	if _, err := time.Parse(time.RFC3339, o.DateCreated); err != nil {
+		addErr("/date_created", "must be a timestamp in RFC3339 format")
+	}
+
+	required("/delivery/name", o.Delivery.Name)
+	required("/delivery/phone", o.Delivery.Phone)
+	required("/delivery/city", o.Delivery.City)
+	required("/delivery/address", o.Delivery.Address)
+	if o.Delivery.Email != "" {
+		if _, err := mail.ParseAddress(o.Delivery.Email); err != nil {
+			addErr("/delivery/email", "must be a valid email address")
+		}
+	}
+
+	required("/payment/transaction", o.Payment.Transaction)
+	required("/payment/provider", o.Payment.Provider)
+	if len(o.Payment.Currency) != 3 || strings.ToUpper(o.Payment.Currency) != o.Payment.Currency {
+		addErr("/payment/currency", "must be a three-letter uppercase currency code")
+	}
+	if o.Payment.PaymentDt <= 0 {
+		addErr("/payment/payment_dt", "must be positive")
+	}
+	nonNegative("/payment/amount", o.Payment.Amount)
+	nonNegative("/payment/delivery_cost", o.Payment.DeliveryCost)
+	nonNegative("/payment/goods_total", o.Payment.GoodsTotal)
+	nonNegative("/payment/custom_fee", o.Payment.CustomFee)
+	if expected := o.Payment.GoodsTotal + o.Payment.DeliveryCost + o.Payment.CustomFee; o.Payment.Amount != expected {
+		addErr("/payment/amount", fmt.Sprintf("must be equal to goods_total + delivery_cost + custom_fee (%v)", expected))
+	}
+
+	if len(o.Items) == 0 {
+		addErr("/items", "must contain at least one item")
+	}
+	itemsTotal := 0
+	for idx, item := range o.Items {
+		pointer := fmt.Sprintf("/items/%v", idx)
+		if item.ChrtId <= 0 {
+			addErr(pointer+"/chrt_id", "must be positive")
+		}
+		if item.NmId <= 0 {
+			addErr(pointer+"/nm_id", "must be positive")
+		}
+		required(pointer+"/name", item.Name)
+		if item.TrackNumber != o.TrackNumber {
+			addErr(pointer+"/track_number", "must be equal to track_number of the order")
+		}
+		nonNegative(pointer+"/price", item.Price)
+		nonNegative(pointer+"/total_price", item.TotalPrice)
+		if item.Sale < 0 || item.Sale > 100 {
+			addErr(pointer+"/sale", "must be between 0 and 100")
+		}
+		itemsTotal += item.TotalPrice
+	}
+	if len(o.Items) > 0 && o.Payment.GoodsTotal != itemsTotal {
+		addErr("/payment/goods_total", fmt.Sprintf("must be equal to sum of items total_price (%v)", itemsTotal))
+	}
+
+	return errs
+}
+
+// Точность, с которой Postgres хранит timestamptz
+const timestampPrecision = time.Microsecond
+
+// Разбор даты заказа или фильтра. Даты приводятся к точности хранения в базе, чтобы заказы из кэша,
+// из памяти и из Postgres сравнивались одинаково
+func ParseTimestamp(value string) (time.Time, error) {
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return timestamp.Truncate(timestampPrecision), nil
+}
+
+// Дата в том виде, в котором сервис её отдаёт: RFC3339 в UTC. Для нулевого времени - пустая строка
+func FormatTimestamp(timestamp time.Time) string {
+	if timestamp.IsZero() {
+		return ""
+	}
+	return timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+// Приведение валидного заказа к виду, в котором он хранится: date_created в UTC с точностью хранения в базе.
+// Так заказ, только что положенный в кэш, не отличается от того же заказа, прочитанного из Postgres
+func (o *Order) Normalize() {
+	if dateCreated, err := ParseTimestamp(o.DateCreated); err == nil {
+		o.DateCreated = FormatTimestamp(dateCreated)
+	}
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// Метрики сервиса для Prometheus. Все метрики регистрируются в собственном реестре Registry (а не в глобальном
+// реестре prometheus), вместе с метриками рантайма Go и процесса, и отдаются через Handler
+const namespace = "wbtech"
+
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// HTTP: количество и длительность запросов по шаблону маршрута (/orders/{order_uid}, а не конкретный путь)
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// Kafka: обработанные и неудачные попытки обработки сообщений, отставание группы по партициям
+// и длительность отправки сообщений продюсером
+var (
+	KafkaMessagesConsumed = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "messages_consumed_total",
+		Help:      "Number of successfully processed messages by topic.",
+	}, []string{"topic"})
+	KafkaMessagesFailed = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "messages_failed_total",
+		Help:      "Number of failed message processing attempts by topic.",
+	}, []string{"topic"})
+	KafkaConsumerLag = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "consumer_lag",
+		Help:      "Number of messages in partition not yet processed by consumer group.",
+	}, []string{"topic", "partition"})
+	KafkaProducerSendDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "producer_send_duration_seconds",
+		Help:      "Duration of sending messages to Kafka by topic and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"topic", "result"})
+)
+
+// Кэш: попадания, промахи, вытеснения и текущий размер
+var (
+	CacheHits = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Number of orders found in cache.",
+	})
+	CacheMisses = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Number of orders not found in cache, including expired ones.",
+	})
+	CacheEvictions = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Number of orders evicted from cache by eviction policy.",
+	})
+	CacheEntries = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "entries",
+		Help:      "Number of orders in cache.",
+	})
+	CacheBytes = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "bytes",
+		Help:      "Size of orders in cache in bytes.",
+	})
+)
+
+// Postgres: длительность запросов по типу и таблице (например, "select orders", "insert order_items")
+var PostgresQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Subsystem: "postgres",
+	Name:      "query_duration_seconds",
+	Help:      "Duration of Postgres queries by statement.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"statement"})
+
+// Результат операции для метки result
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Время, прошедшее с start, в секундах - для наблюдения в гистограммах
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// HTTP-обработчик, отдающий метрики в формате Prometheus
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -1,12 +1,267 @@
 package postgres
 
-import "gorm.io/gorm"
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
-// Библиотека gorm предоставляет возможность делать автоматические миграции нужных нам сущностей
-// Если сущность не была создана, то gorm её автоматически создаст
+// SQL-миграции вшиты в бинарник. Файлы называются <версия>_<название>.up.sql и <версия>_<название>.down.sql,
+// версии идут по порядку. Применённые версии записываются в таблицу schema_migrations
+//
+//go:embed sql/*.sql
+var migrationFiles embed.FS
+
+// Ключ advisory lock'а, под которым выполняются миграции: несколько экземпляров сервиса, запущенных одновременно,
+// применяют миграции по очереди
+const migrationsLockKey = 20241127
+
+var ErrNoDownMigration = errors.New("migration has no down script")
+
+// Одна миграция схемы
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Состояние миграции в базе. AppliedAt пустой, если миграция ещё не применена
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Накатывание всех неприменённых миграций при старте сервиса. Паникует, если миграции не удалось применить
 func MakeMigrations(conn *gorm.DB) {
-	err := conn.AutoMigrate(&Order{}, &Delivery{}, &Payment{}, &Item{})
+	if _, err := MigrateUp(context.Background(), conn); err != nil {
+		panic(fmt.Sprintf("can't make migrations in postgres database: %v", err))
+	}
+}
+
+// Чтение вшитых миграций, отсортированных по версии
+func LoadMigrations() ([]Migration, error) {
+	files, err := fs.ReadDir(migrationFiles, "sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		name, direction, isValid := strings.Cut(strings.TrimSuffix(file.Name(), ".sql"), ".")
+		versionPart, migrationName, hasName := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionPart)
+		if !isValid || !hasName || err != nil || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %v", file.Name())
+		}
+		content, err := migrationFiles.ReadFile(path.Join("sql", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migration, isExists := byVersion[version]
+		if !isExists {
+			migration = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = migration
+		}
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %v has no up script", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Применение всех неприменённых миграций. Каждая миграция выполняется в своей транзакции вместе с записью
+// в schema_migrations, поэтому при ошибке база остаётся на последней успешно применённой версии.
+// Возвращает список применённых миграций
+func MigrateUp(ctx context.Context, conn *gorm.DB) ([]Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	db, err := conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0)
+	for _, migration := range migrations {
+		isApplied, err := runLocked(ctx, db, func(tx *sql.Tx) (bool, error) {
+			var exists bool
+			if err := tx.QueryRowContext(ctx,
+				"SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)",
+				migration.Version).Scan(&exists); err != nil {
+				return false, err
+			}
+			if exists {
+				return false, nil
+			}
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return false, err
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+				migration.Version, migration.Name)
+			return err == nil, err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("failed on applying migration %v_%v: %w", migration.Version, migration.Name, err)
+		}
+		if isApplied {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// Откат последних steps применённых миграций, по одной в транзакции. Возвращает список откаченных миграций
+func MigrateDown(ctx context.Context, conn *gorm.DB, steps int) ([]Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+	db, err := conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	reverted := make([]Migration, 0, steps)
+	for len(reverted) < steps {
+		var migration Migration
+		isReverted, err := runLocked(ctx, db, func(tx *sql.Tx) (bool, error) {
+			var version int
+			err := tx.QueryRowContext(ctx, "SELECT version FROM schema_migrations ORDER BY version DESC LIMIT 1").
+				Scan(&version)
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			var isKnown bool
+			migration, isKnown = byVersion[version]
+			if !isKnown {
+				return false, fmt.Errorf("applied migration %v is unknown to this binary", version)
+			}
+			if migration.Down == "" {
+				return false, fmt.Errorf("%w: %v_%v", ErrNoDownMigration, migration.Version, migration.Name)
+			}
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return false, err
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", version)
+			return err == nil, err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("failed on reverting migration: %w", err)
+		}
+		if !isReverted {
+			break
+		}
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
+
+// Состояние всех известных миграций
+func Status(ctx context.Context, conn *gorm.DB) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	db, err := conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := MigrationStatus{Migration: migration}
+		if at, isApplied := appliedAt[migration.Version]; isApplied {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func ensureMigrationsTable(ctx context.Context, db *sql.DB) error {
+	_, err := runLocked(ctx, db, func(tx *sql.Tx) (bool, error) {
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    bigint PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`)
+		return err == nil, err
+	})
+	return err
+}
+
+// Выполнение fn в транзакции под advisory lock'ом. Блокировка транзакционная и снимается вместе с коммитом или
+// откатом, так что не зависит от того, какое соединение пула досталось
+func runLocked(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) (bool, error)) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationsLockKey); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	result, err := fn(tx)
 	if err != nil {
-		panic("can't make migrations in postgres database")
+		_ = tx.Rollback()
+		return false, err
 	}
+	return result, tx.Commit()
 }
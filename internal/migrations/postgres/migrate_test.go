@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"os"
+	"testing"
+	"time"
+)
+
+// Тесты миграций выполняются на живом Postgres: DSN берётся из POSTGRES_TEST_DSN, без него тесты пропускаются.
+// Каждый тест работает в своей схеме, которая удаляется после теста
+func newTestMigrationsDB(t *testing.T) (*gorm.DB, *sql.DB) {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	db, err := conn.DB()
+	if err != nil {
+		t.Fatalf("connection pool: %v", err)
+	}
+	// search_path задаётся на соединении, поэтому оно должно быть единственным в пуле
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if _, err = db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+	if _, err = db.Exec("SET search_path TO " + schema); err != nil {
+		t.Fatalf("set search_path: %v", err)
+	}
+	return conn, db
+}
+
+func TestDateCreatedMigrationReplacesInvalidDatesWithNull(t *testing.T) {
+	conn, db := newTestMigrationsDB(t)
+	ctx := context.Background()
+
+	// Накатываем только первую миграцию и пишем заказы так, как их писал сервис до валидации date_created
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if err = ensureMigrationsTable(ctx, db); err != nil {
+		t.Fatalf("migrations table: %v", err)
+	}
+	if _, err = db.Exec(migrations[0].Up); err != nil {
+		t.Fatalf("apply %v: %v", migrations[0].Name, err)
+	}
+	if _, err = db.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+		migrations[0].Version, migrations[0].Name); err != nil {
+		t.Fatalf("mark %v as applied: %v", migrations[0].Name, err)
+	}
+	legacyDates := map[string]string{
+		"valid":     "2021-11-26T06:22:19Z",
+		"empty":     "",
+		"malformed": "26.11.2021 вечером",
+		"overflow":  "2021-13-45T25:61:00Z",
+	}
+	for orderUid, dateCreated := range legacyDates {
+		if _, err = db.Exec("INSERT INTO orders (order_uid, date_created) VALUES ($1, $2)",
+			orderUid, dateCreated); err != nil {
+			t.Fatalf("insert legacy order: %v", err)
+		}
+	}
+
+	if _, err = MigrateUp(ctx, conn); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+
+	rows, err := db.Query("SELECT order_uid, date_created FROM orders")
+	if err != nil {
+		t.Fatalf("select orders: %v", err)
+	}
+	defer rows.Close()
+	migrated := make(map[string]sql.NullTime)
+	for rows.Next() {
+		var orderUid string
+		var dateCreated sql.NullTime
+		if err = rows.Scan(&orderUid, &dateCreated); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		migrated[orderUid] = dateCreated
+	}
+	if len(migrated) != len(legacyDates) {
+		t.Fatalf("expected %v orders after migration, got %v", len(legacyDates), len(migrated))
+	}
+	expected := time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC)
+	if !migrated["valid"].Valid || !migrated["valid"].Time.Equal(expected) {
+		t.Fatalf("expected valid date %v, got %+v", expected, migrated["valid"])
+	}
+	for _, orderUid := range []string{"empty", "malformed", "overflow"} {
+		if migrated[orderUid].Valid {
+			t.Fatalf("expected NULL date for %v order, got %v", orderUid, migrated[orderUid].Time)
+		}
+	}
+}
@@ -1,46 +1,62 @@
 package postgres
 
 import (
-	"github.com/lib/pq"
+	"time"
 )
 
 // Файл с внутренними сущностями сервиса
 
-// Структура сущности заказа. В ней переопределены поля с доставкой, списком вещей и платежом.
-// В дальнейшем при поступлении нового JSON в переопределенные поля присваиваются новые ID,
-// по ним сервис ищет в нескольких таблицах информацию и собирает в обратный JSON
+// Структура сущности заказа. Заказ - главная таблица: доставка, платёж и вещи ссылаются на него по order_uid
+// внешними ключами и удаляются вместе с ним. Сама схема описана в SQL-миграциях (папка sql), теги gorm должны
+// ей соответствовать. Поля Delivery, Payment и Items заполняются при сборке заказа и не сохраняются при его записи.
+// ContentHash - хэш содержимого входящего JSON, по нему определяются повторно присланные заказы.
+// DateCreated хранится как timestamptz, чтобы фильтры, сортировка и курсор списка заказов сравнивали даты одинаково.
+// UpdatedAt - время последней записи заказа, по нему кэш подтягивает только изменившиеся заказы
 type Order struct {
-	OrderUid          string
+	OrderUid          string `gorm:"primaryKey"`
 	TrackNumber       string
 	Entry             string
-	OrderDeliveryID   string
-	OrderPaymentID    string
-	OrderItemsID      pq.StringArray `gorm:"type:text[]"`
+	Delivery          Delivery `gorm:"foreignKey:OrderUid;references:OrderUid;constraint:OnDelete:CASCADE"`
+	Payment           Payment  `gorm:"foreignKey:OrderUid;references:OrderUid;constraint:OnDelete:CASCADE"`
+	Items             []Item   `gorm:"foreignKey:OrderUid;references:OrderUid;constraint:OnDelete:CASCADE"`
 	Locale            string
 	InternalSignature string
 	CustomerId        string
 	DeliveryService   string
 	Shardkey          string
 	SmId              int
-	DateCreated       string
+	DateCreated       time.Time
 	OofShard          string
+	ContentHash       string
+	Version           int       `gorm:"default:1"`
+	UpdatedAt         time.Time `gorm:"index;default:now()"`
 }
 
-// Сущность для доставки
+// Сохранённая предыдущая версия заказа (при ConflictPolicyVersion). Content - заказ в формате JSON из тех.задания
+// в том виде, в каком он был до замены, ReplacedAt - время замены
+type OrderVersion struct {
+	OrderUid    string `gorm:"primaryKey"`
+	Version     int    `gorm:"primaryKey;autoIncrement:false"`
+	ContentHash string
+	Content     string    `gorm:"type:jsonb"`
+	ReplacedAt  time.Time `gorm:"default:now()"`
+}
+
+// Сущность для доставки. У заказа ровно одна доставка, поэтому ключом служит order_uid
 type Delivery struct {
-	DeliveryID string
-	Name       string
-	Phone      string
-	Zip        string
-	City       string
-	Address    string
-	Region     string
-	Email      string
+	OrderUid string `gorm:"primaryKey"`
+	Name     string
+	Phone    string
+	Zip      string
+	City     string
+	Address  string
+	Region   string
+	Email    string
 }
 
-// Сущность для платежа
+// Сущность для платежа. У заказа ровно один платёж, поэтому ключом служит order_uid
 type Payment struct {
-	PaymentID    string
+	OrderUid     string `gorm:"primaryKey"`
 	Transaction  string
 	RequestId    string
 	Currency     string
@@ -53,9 +69,12 @@ type Payment struct {
 	CustomFee    int
 }
 
-// Сущность для вещи из заказа. В таблице orders хранится массив из chrt_id
+// Сущность для вещи из заказа. Ключ - order_uid и позиция вещи в заказе, так что одинаковые chrt_id
+// в разных заказах (и внутри одного заказа) не пересекаются
 type Item struct {
-	ChrtId      int
+	OrderUid    string `gorm:"primaryKey"`
+	Position    int    `gorm:"primaryKey;autoIncrement:false"`
+	ChrtId      int    `gorm:"index"`
 	TrackNumber string
 	Price       int
 	Rid         string
@@ -67,3 +86,8 @@ type Item struct {
 	Brand       string
 	Status      int
 }
+
+// Вещи хранятся в таблице order_items
+func (Item) TableName() string {
+	return "order_items"
+}
@@ -0,0 +1,132 @@
+-- Нормализованная схема: доставка, платёж и вещи ссылаются на заказ по order_uid и удаляются вместе с ним.
+-- Миграция идемпотентна для баз, созданных через gorm AutoMigrate, а старую схему (заказ ссылается на доставку,
+-- платёж и вещи по сгенерированным ID) переносит в новую
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'orders'
+                 AND column_name = 'order_delivery_id') THEN
+        ALTER TABLE orders ADD COLUMN IF NOT EXISTS content_hash text,
+            ADD COLUMN IF NOT EXISTS version bigint DEFAULT 1,
+            ADD COLUMN IF NOT EXISTS updated_at timestamptz DEFAULT now();
+        DROP INDEX IF EXISTS idx_orders_order_uid;
+        DROP INDEX IF EXISTS idx_orders_updated_at;
+        ALTER TABLE orders RENAME TO legacy_orders;
+        ALTER TABLE deliveries RENAME TO legacy_deliveries;
+        ALTER TABLE payments RENAME TO legacy_payments;
+        ALTER TABLE items RENAME TO legacy_items;
+    END IF;
+END
+$$;
+
+CREATE TABLE IF NOT EXISTS orders (
+    order_uid          text PRIMARY KEY,
+    track_number       text,
+    entry              text,
+    locale             text,
+    internal_signature text,
+    customer_id        text,
+    delivery_service   text,
+    shardkey           text,
+    sm_id              bigint,
+    date_created       text,
+    oof_shard          text,
+    content_hash       text,
+    version            bigint      DEFAULT 1,
+    updated_at         timestamptz DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_orders_updated_at ON orders (updated_at);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    order_uid text PRIMARY KEY,
+    name      text,
+    phone     text,
+    zip       text,
+    city      text,
+    address   text,
+    region    text,
+    email     text,
+    CONSTRAINT fk_orders_delivery FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS payments (
+    order_uid     text PRIMARY KEY,
+    transaction   text,
+    request_id    text,
+    currency      text,
+    provider      text,
+    amount        bigint,
+    payment_dt    bigint,
+    bank          text,
+    delivery_cost bigint,
+    goods_total   bigint,
+    custom_fee    bigint,
+    CONSTRAINT fk_orders_payment FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    order_uid    text,
+    position     bigint,
+    chrt_id      bigint,
+    track_number text,
+    price        bigint,
+    rid          text,
+    name         text,
+    sale         bigint,
+    size         text,
+    total_price  bigint,
+    nm_id        bigint,
+    brand        text,
+    status       bigint,
+    PRIMARY KEY (order_uid, position),
+    CONSTRAINT fk_orders_items FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_order_items_chrt_id ON order_items (chrt_id);
+
+-- В старой схеме order_uid мог повторяться (уникальный индекс на него появился позже и не создавался, если
+-- дубли уже были), поэтому для каждого order_uid переносится только последняя строка: с наибольшей версией,
+-- а при равных версиях - записанная последней. Первичного ключа у старых таблиц нет, порядок записи строк
+-- определяется по ctid.
+-- Вещи в старой схеме искались по chrt_id без привязки к заказу, поэтому для заказов с одинаковыми chrt_id
+-- восстановить исходные вещи нельзя - берётся первая записанная строка с таким chrt_id
+DO $$
+BEGIN
+    IF to_regclass('legacy_orders') IS NOT NULL THEN
+        CREATE TEMPORARY TABLE latest_legacy_orders ON COMMIT DROP AS
+            SELECT DISTINCT ON (order_uid) * FROM legacy_orders
+            ORDER BY order_uid, version DESC NULLS LAST, ctid DESC;
+
+        INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id,
+                            delivery_service, shardkey, sm_id, date_created, oof_shard, content_hash, version,
+                            updated_at)
+        SELECT lo.order_uid, lo.track_number, lo.entry, lo.locale, lo.internal_signature, lo.customer_id,
+               lo.delivery_service, lo.shardkey, lo.sm_id, lo.date_created, lo.oof_shard,
+               COALESCE(lo.content_hash, ''), COALESCE(lo.version, 1), COALESCE(lo.updated_at, now())
+        FROM latest_legacy_orders lo;
+
+        INSERT INTO deliveries (order_uid, name, phone, zip, city, address, region, email)
+        SELECT lo.order_uid, d.name, d.phone, d.zip, d.city, d.address, d.region, d.email
+        FROM latest_legacy_orders lo
+        JOIN legacy_deliveries d ON d.delivery_id = lo.order_delivery_id;
+
+        INSERT INTO payments (order_uid, transaction, request_id, currency, provider, amount, payment_dt, bank,
+                              delivery_cost, goods_total, custom_fee)
+        SELECT lo.order_uid, p.transaction, p.request_id, p.currency, p.provider, p.amount, p.payment_dt, p.bank,
+               p.delivery_cost, p.goods_total, p.custom_fee
+        FROM latest_legacy_orders lo
+        JOIN legacy_payments p ON p.payment_id = lo.order_payment_id;
+
+        INSERT INTO order_items (order_uid, position, chrt_id, track_number, price, rid, name, sale, size,
+                                 total_price, nm_id, brand, status)
+        SELECT lo.order_uid, ids.position - 1, i.chrt_id, i.track_number, i.price, i.rid, i.name, i.sale, i.size,
+               i.total_price, i.nm_id, i.brand, i.status
+        FROM latest_legacy_orders lo
+        CROSS JOIN LATERAL unnest(lo.order_items_id) WITH ORDINALITY AS ids (chrt_id, position)
+        JOIN LATERAL (SELECT * FROM legacy_items li WHERE li.chrt_id = ids.chrt_id::bigint
+                           ORDER BY li.ctid LIMIT 1) i ON true;
+
+        DROP TABLE legacy_orders, legacy_deliveries, legacy_payments, legacy_items;
+    END IF;
+END
+$$;
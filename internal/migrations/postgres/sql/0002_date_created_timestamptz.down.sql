@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_date_created;
+ALTER TABLE orders ALTER COLUMN date_created TYPE text
+    USING to_char(date_created AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"');
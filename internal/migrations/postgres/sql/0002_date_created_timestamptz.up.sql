@@ -0,0 +1,20 @@
+-- date_created хранился строкой: фильтры по датам сравнивали его как момент времени, а сортировка и курсор списка
+-- заказов - как текст, и для дат с разными часовыми поясами или долями секунды порядок расходился.
+-- Теперь это timestamptz, и везде используется сравнение моментов времени.
+-- До появления валидации в date_created могло попасть что угодно, поэтому значения приводятся через функцию,
+-- которая не роняет миграцию: пустые строки и строки, которые не разбираются как дата, становятся NULL
+-- (такие значения попадают в лог Postgres предупреждением)
+CREATE OR REPLACE FUNCTION migration_0002_to_timestamptz(value text) RETURNS timestamptz
+    LANGUAGE plpgsql AS $$
+BEGIN
+    RETURN NULLIF(btrim(value), '')::timestamptz;
+EXCEPTION
+    WHEN data_exception THEN
+        RAISE WARNING 'date_created % is not a timestamp, replaced with NULL', quote_literal(value);
+        RETURN NULL;
+END
+$$;
+
+ALTER TABLE orders ALTER COLUMN date_created TYPE timestamptz USING migration_0002_to_timestamptz(date_created);
+DROP FUNCTION migration_0002_to_timestamptz(text);
+CREATE INDEX IF NOT EXISTS idx_orders_date_created ON orders (date_created, order_uid);
@@ -0,0 +1,11 @@
+-- История заказов при ORDER_CONFLICT_POLICY=version: перед записью новой версии заказа предыдущая сохраняется
+-- сюда целиком, в формате JSON из тех.задания. Внешнего ключа на orders нет: при замене версии строки заказа
+-- удаляются и записываются заново, а история должна остаться
+CREATE TABLE IF NOT EXISTS order_versions (
+    order_uid    text        NOT NULL,
+    version      bigint      NOT NULL,
+    content_hash text,
+    content      jsonb       NOT NULL,
+    replaced_at  timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (order_uid, version)
+);
@@ -1,35 +1,95 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/nehachuha1/wbtech-tasks/internal/config"
 	"github.com/nehachuha1/wbtech-tasks/internal/database"
 	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers/health"
 	"github.com/nehachuha1/wbtech-tasks/internal/handlers/orders"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
 	"go.uber.org/zap"
 	"html/template"
 )
 
-// Сборка в роутер хэндлера заказов + инициализация дата менеджера. Логгер передаём из main.go
-func BuildNewServer(templ *template.Template, logger *zap.SugaredLogger) *mux.Router {
+// Собранный сервер: роутер и управляющие структуры, которые нужно остановить при завершении работы сервиса
+type Server struct {
+	Router        *mux.Router
+	DataManager   *database.DataManager
+	KafkaProducer producer.OrderProducer
+	Health        *health.HealthHandler
+	Logger        *zap.SugaredLogger
+}
+
+// Сборка в роутер хэндлера заказов + инициализация дата менеджера. Конфиг сервера и логгер передаём из main.go
+func BuildNewServer(templ *template.Template, serverConfig *config.ServerConfig, logger *zap.SugaredLogger) *Server {
 	kafkaConfig := config.NewKafkaConfig()
 	cacheConfig := config.NewCacheConfig()
 	postgresConfig := config.NewPostgresConfig()
+	retryConfig := config.NewRetryConfig()
 
-	dataManager := database.NewDataManager(postgresConfig, cacheConfig, kafkaConfig, logger)
+	dataManager := database.NewDataManager(postgresConfig, cacheConfig, kafkaConfig, retryConfig, logger)
 	kafkaProducer := producer.NewKafkaProducer(kafkaConfig, logger)
+	return NewServer(templ, serverConfig, dataManager, kafkaProducer, retryConfig, logger)
+}
 
+// Сборка роутера поверх уже созданных менеджера данных и продюсера. Отдельно от BuildNewServer нужна для того,
+// чтобы собрать сервер со встроенными хранилищем и брокером (например, в end-to-end тестах)
+func NewServer(templ *template.Template, serverConfig *config.ServerConfig, dataManager *database.DataManager,
+	kafkaProducer producer.OrderProducer, retryConfig *config.RetryConfig, logger *zap.SugaredLogger) *Server {
 	ordersHandler := &orders.OrderHandler{
 		Templates:     templ,
 		Logger:        logger,
-		DataManager:   dataManager,
+		Orders:        dataManager,
 		KafkaProducer: kafkaProducer,
+		RetryPolicy:   retryConfig.Policy(),
+	}
+	healthHandler := &health.HealthHandler{
+		Logger:  logger,
+		Checker: dataManager,
 	}
 
 	r := mux.NewRouter()
+	r.Use(requestMetrics)
+	r.Use(correlationID)
+	r.Use(requestTimeout(serverConfig.RequestTimeout))
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", healthHandler.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", healthHandler.Readyz).Methods("GET")
 	r.HandleFunc("/", ordersHandler.Index).Methods("GET")
 	r.HandleFunc("/create", ordersHandler.CreateOrder).Methods("POST")
 	r.HandleFunc("/get", ordersHandler.GetOrder).Methods("POST")
+	r.HandleFunc("/orders", ordersHandler.ListOrders).Methods("GET")
+	r.HandleFunc("/orders/{order_uid}", ordersHandler.GetOrderByUID).Methods("GET")
 
-	return r
+	return &Server{
+		Router:        r,
+		DataManager:   dataManager,
+		KafkaProducer: kafkaProducer,
+		Health:        healthHandler,
+		Logger:        logger,
+	}
+}
+
+// Начало остановки: /readyz начинает отвечать 503, а запросы продолжают обрабатываться, пока балансировщик
+// не уберёт сервис из ротации
+func (s *Server) Drain() {
+	s.Health.Drain()
+	s.Logger.Info("server is draining, readiness is off")
+}
+
+// Остановка компонентов сервера. Вызывается после того, как HTTP-сервер перестал принимать запросы:
+// сначала отправляем накопленные продюсером сообщения, затем останавливаем менеджер данных
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	if err := s.KafkaProducer.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed on closing producer: %w", err))
+	}
+	if err := s.DataManager.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/nehachuha1/wbtech-tasks/internal/metrics"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Максимальная длина correlation ID, принимаемого от клиента. Более длинные значения заменяются новым ID,
+// чтобы клиент не мог раздувать ими логи
+const maxCorrelationIDLength = 64
+
+// Middleware, ограничивающая время обработки запроса. Контекст запроса отменяется по истечении timeout или
+// когда клиент закрыл соединение, и эта отмена доходит до запросов в Postgres и ожидания брокера
+func requestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Middleware, которая присваивает запросу correlation ID: берём его из заголовка X-Correlation-ID, если клиент
+// его прислал, иначе генерируем новый. ID кладётся в контекст запроса (оттуда его берут логи обработчиков,
+// менеджера данных, кэша и Postgres, а также продюсер - в заголовок сообщения) и возвращается в ответе
+func correlationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(log.CorrelationHeader)
+		if id == "" || len(id) > maxCorrelationIDLength {
+			id = log.NewCorrelationID()
+		}
+		w.Header().Set(log.CorrelationHeader, id)
+		next.ServeHTTP(w, r.WithContext(log.WithCorrelationID(r.Context(), id)))
+	})
+}
+
+// Middleware, считающая количество и длительность запросов. Запросы группируются по шаблону маршрута,
+// чтобы у метрик не было отдельной серии на каждый order_uid
+func requestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		metrics.HTTPRequestDuration.WithLabelValues(route, r.Method).Observe(metrics.Since(start))
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+// Обёртка над http.ResponseWriter, запоминающая код ответа
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
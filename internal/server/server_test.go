@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/IBM/sarama"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nehachuha1/wbtech-tasks/internal/config"
+	"github.com/nehachuha1/wbtech-tasks/internal/database"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/memory"
+	"github.com/nehachuha1/wbtech-tasks/internal/database/kafka/producer"
+	pg "github.com/nehachuha1/wbtech-tasks/internal/database/postgres"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers/health"
+	"github.com/nehachuha1/wbtech-tasks/internal/testutil"
+	"github.com/nehachuha1/wbtech-tasks/pkg/log"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Окружение end-to-end тестов: сервер поверх хранилища в памяти и встроенного брокера
+type testEnv struct {
+	server *httptest.Server
+	app    *Server
+	store  *pg.MemoryDatabase
+	broker *memory.Broker
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	logger := zap.NewNop().Sugar()
+	kafkaConfig := &config.KafkaConfig{
+		Topic:           "orders",
+		DeadLetterTopic: "orders-dlq",
+		GroupID:         "orders-service",
+		RetryInterval:   time.Millisecond * 10,
+		MessageTimeout:  time.Second,
+	}
+	retryConfig := &config.RetryConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond * 5,
+		Multiplier:     2,
+	}
+	env := &testEnv{
+		store:  pg.NewMemoryDatabase(pg.ConflictPolicyReject, logger),
+		broker: memory.NewBroker(3),
+	}
+
+	dataManager := database.NewDataManagerWithStore(env.store,
+		&config.CacheConfig{ClearInterval: time.Hour, CacheLimit: 100, EvictionPolicy: "lru"}, retryConfig, logger)
+	err := dataManager.AttachConsumer(memory.NewConsumer(env.broker, kafkaConfig, logger),
+		memory.NewProducer(env.broker, kafkaConfig, logger))
+	if err != nil {
+		t.Fatalf("attach consumer: %v", err)
+	}
+	srv := NewServer(nil, &config.ServerConfig{RequestTimeout: time.Second * 5}, dataManager,
+		memory.NewProducer(env.broker, kafkaConfig, logger), retryConfig, logger)
+	env.server = httptest.NewServer(srv.Router)
+	env.app = srv
+
+	t.Cleanup(func() {
+		env.server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	})
+	return env
+}
+
+func (env *testEnv) createOrder(t *testing.T, body []byte) *http.Response {
+	t.Helper()
+	response, err := http.Post(env.server.URL+"/create", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post /create: %v", err)
+	}
+	response.Body.Close()
+	return response
+}
+
+// Ожидание, пока заказ пройдёт через очередь и станет доступен по GET /orders/{order_uid}
+func (env *testEnv) waitForOrder(t *testing.T, orderUid string) *handlers.Order {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		response, err := http.Get(env.server.URL + "/orders/" + orderUid)
+		if err != nil {
+			t.Fatalf("get order: %v", err)
+		}
+		if response.StatusCode == http.StatusOK {
+			order := &handlers.Order{}
+			err = json.NewDecoder(response.Body).Decode(order)
+			response.Body.Close()
+			if err != nil {
+				t.Fatalf("decode order: %v", err)
+			}
+			return order
+		}
+		response.Body.Close()
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("order %v didn't become available", orderUid)
+	return nil
+}
+
+func TestCreatedOrderGoesThroughQueueToCache(t *testing.T) {
+	env := newTestEnv(t)
+
+	if response := env.createOrder(t, testutil.OrderJSON("e2e-order", testutil.DateCreated)); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /create, got %v", response.StatusCode)
+	}
+	order := env.waitForOrder(t, "e2e-order")
+	if order.Payment.Amount != 1817 || len(order.Items) != 2 {
+		t.Fatalf("unexpected order: %+v", order)
+	}
+	if _, err := env.store.Get(context.Background(), "e2e-order"); err != nil {
+		t.Fatalf("order is not stored: %v", err)
+	}
+
+	// Повторная отправка того же заказа не создаёт ничего нового и не попадает в dead-letter топик
+	if response := env.createOrder(t, testutil.OrderJSON("e2e-order", testutil.DateCreated)); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /create, got %v", response.StatusCode)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if messages := env.broker.Messages("orders-dlq"); len(messages) != 0 {
+		t.Fatalf("duplicate order was sent to dead-letter topic")
+	}
+}
+
+func TestInvalidOrderIsRejectedBeforeQueue(t *testing.T) {
+	env := newTestEnv(t)
+
+	response := env.createOrder(t, []byte(`{"order_uid": "invalid"}`))
+	if response.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v", response.StatusCode)
+	}
+	if messages := env.broker.Messages("orders"); len(messages) != 0 {
+		t.Fatalf("invalid order reached the queue")
+	}
+}
+
+func TestUnprocessableMessagesGoToDeadLetterTopic(t *testing.T) {
+	env := newTestEnv(t)
+	if _, _, err := env.broker.Produce(&sarama.ProducerMessage{Topic: "orders",
+		Value: sarama.StringEncoder("not an order")}); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	if response := env.createOrder(t, testutil.OrderJSON("after-garbage", testutil.DateCreated)); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /create, got %v", response.StatusCode)
+	}
+	env.waitForOrder(t, "after-garbage")
+
+	var deadLetters []*sarama.ConsumerMessage
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if deadLetters = env.broker.Messages("orders-dlq"); len(deadLetters) > 0 {
+			break
+		}
+	}
+	if len(deadLetters) != 1 || string(deadLetters[0].Value) != "not an order" {
+		t.Fatalf("expected the invalid message in dead-letter topic, got %v messages", len(deadLetters))
+	}
+	headers := make(map[string]string)
+	for _, header := range deadLetters[0].Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	if headers[producer.HeaderFailureStage] != pg.StageUnmarshal || headers[producer.HeaderOriginalTopic] != "orders" {
+		t.Fatalf("unexpected dead-letter headers: %v", headers)
+	}
+}
+
+func TestMessageIsRedeliveredUntilPostgresRecovers(t *testing.T) {
+	env := newTestEnv(t)
+	// Больше, чем попыток в политике повторов: сообщение будет обработано только после повторной доставки
+	env.store.FailOn(pg.OpWrite, pg.StageCommit, &pgconn.PgError{Code: "57P03"}, 5)
+
+	if response := env.createOrder(t, testutil.OrderJSON("redelivered", testutil.DateCreated)); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /create, got %v", response.StatusCode)
+	}
+	env.waitForOrder(t, "redelivered")
+	if messages := env.broker.Messages("orders-dlq"); len(messages) != 0 {
+		t.Fatalf("transient failure was sent to dead-letter topic")
+	}
+}
+
+func TestCreateOrderWhenBrokerIsUnavailable(t *testing.T) {
+	env := newTestEnv(t)
+	env.broker.SetUnavailable(true)
+
+	if response := env.createOrder(t, testutil.OrderJSON("unsent", testutil.DateCreated)); response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", response.StatusCode)
+	}
+}
+
+func TestCorrelationIDIsPropagatedToQueue(t *testing.T) {
+	env := newTestEnv(t)
+
+	request, err := http.NewRequest(http.MethodPost, env.server.URL+"/create",
+		bytes.NewReader(testutil.OrderJSON("correlated", testutil.DateCreated)))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	request.Header.Set(log.CorrelationHeader, "test-correlation-id")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("post /create: %v", err)
+	}
+	response.Body.Close()
+	if response.Header.Get(log.CorrelationHeader) != "test-correlation-id" {
+		t.Fatalf("unexpected correlation ID in response: %q", response.Header.Get(log.CorrelationHeader))
+	}
+
+	messages := env.broker.Messages("orders")
+	if len(messages) != 1 || producer.CorrelationIDFromHeaders(messages[0]) != "test-correlation-id" {
+		t.Fatalf("correlation ID is not passed to the queue")
+	}
+
+	// Без заголовка ID генерируется сервером
+	response = env.createOrder(t, testutil.OrderJSON("uncorrelated", testutil.DateCreated))
+	if response.Header.Get(log.CorrelationHeader) == "" {
+		t.Fatalf("correlation ID is not generated")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	env := newTestEnv(t)
+	if response := env.createOrder(t, testutil.OrderJSON("measured", testutil.DateCreated)); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /create, got %v", response.StatusCode)
+	}
+	env.waitForOrder(t, "measured")
+
+	response, err := http.Get(env.server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("get metrics: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("read metrics: %v", err)
+	}
+	expected := []string{
+		`wbtech_http_requests_total{code="200",method="POST",route="/create"}`,
+		`wbtech_http_request_duration_seconds_bucket{method="GET",route="/orders/{order_uid}"`,
+		`wbtech_kafka_messages_consumed_total{topic="orders"}`,
+		`wbtech_kafka_consumer_lag{partition=`,
+		`wbtech_kafka_producer_send_duration_seconds_count{result="ok",topic="orders"}`,
+		`wbtech_cache_hits_total`,
+		`wbtech_cache_entries`,
+	}
+	for _, metric := range expected {
+		if !strings.Contains(string(body), metric) {
+			t.Fatalf("metric %v is not exposed", metric)
+		}
+	}
+}
+
+func (env *testEnv) readiness(t *testing.T) (int, *health.Report) {
+	t.Helper()
+	response, err := http.Get(env.server.URL + "/readyz")
+	if err != nil {
+		t.Fatalf("get readyz: %v", err)
+	}
+	defer response.Body.Close()
+	report := &health.Report{}
+	if err = json.NewDecoder(response.Body).Decode(report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	return response.StatusCode, report
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	env := newTestEnv(t)
+	<-env.app.DataManager.WarmedUp()
+
+	response, err := http.Get(env.server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("get healthz: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /healthz, got %v", response.StatusCode)
+	}
+	if code, report := env.readiness(t); code != http.StatusOK || report.Status != "ready" {
+		t.Fatalf("expected ready service, got %v: %+v", code, report)
+	}
+
+	// Postgres недоступен - сервис жив, но не готов, и в ответе видно, какой компонент не готов
+	env.store.FailOn(pg.OpPing, "", &pgconn.PgError{Code: "57P03"}, 1)
+	code, report := env.readiness(t)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 when postgres is unavailable, got %v", code)
+	}
+	for _, component := range report.Components {
+		if component.Ready != (component.Name != "postgres") {
+			t.Fatalf("unexpected component state: %+v", component)
+		}
+	}
+
+	env.app.Drain()
+	if code, _ := env.readiness(t); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after drain, got %v", code)
+	}
+}
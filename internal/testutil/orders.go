@@ -0,0 +1,43 @@
+// Общие данные для тестов: валидный заказ из примера к заданию, на котором построены тесты хранилища,
+// менеджера данных, обработчиков и end-to-end тесты сервера
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nehachuha1/wbtech-tasks/internal/handlers"
+	"testing"
+)
+
+// Дата создания тестового заказа по умолчанию
+const DateCreated = "2021-11-26T06:22:19Z"
+
+// JSON валидного заказа с двумя вещами. transaction платежа совпадает с order_uid
+func OrderJSON(orderUid string, dateCreated string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"order_uid": %q, "track_number": "WBILMTESTTRACK", "entry": "WBIL",
+		"delivery": {"name": "Test Testov", "phone": "+9720000000", "zip": "2639809", "city": "Kiryat Mozkin",
+			"address": "Ploshad Mira 15", "region": "Kraiot", "email": "test@gmail.com"},
+		"payment": {"transaction": %q, "currency": "USD", "provider": "wbpay", "amount": 1817,
+			"payment_dt": 1637907727, "bank": "alpha", "delivery_cost": 1500, "goods_total": 317, "custom_fee": 0},
+		"items": [
+			{"chrt_id": 9934930, "track_number": "WBILMTESTTRACK", "price": 453, "rid": "ab4219087a764ae0btest",
+				"name": "Mascaras", "sale": 30, "size": "0", "total_price": 317, "nm_id": 2389212,
+				"brand": "Vivienne Sabo", "status": 202},
+			{"chrt_id": 9934931, "track_number": "WBILMTESTTRACK", "price": 0, "rid": "ab4219087a764ae0btest2",
+				"name": "Gift", "sale": 0, "size": "0", "total_price": 0, "nm_id": 2389213,
+				"brand": "Vivienne Sabo", "status": 202}
+		],
+		"locale": "en", "customer_id": "test", "delivery_service": "meest", "shardkey": "9", "sm_id": 99,
+		"date_created": %q, "oof_shard": "1"}`, orderUid, orderUid, dateCreated))
+}
+
+// Тот же заказ, разобранный в handlers.Order
+func Order(t testing.TB, orderUid string, dateCreated string) *handlers.Order {
+	t.Helper()
+	order := &handlers.Order{}
+	if err := json.Unmarshal(OrderJSON(orderUid, dateCreated), order); err != nil {
+		t.Fatalf("can't build test order: %v", err)
+	}
+	return order
+}
@@ -5,11 +5,12 @@ import (
 	"gorm.io/gorm"
 )
 
-// Очищение базы данных от предыдущих записей (Используется строго для тестирования работы с Postgres)
+// Очищение базы данных от предыдущих записей (Используется строго для тестирования работы с Postgres).
+// Доставки, платежи и вещи удаляются раньше заказов, на которые они ссылаются внешними ключами
 func ClearDatabases(conn *gorm.DB) {
-	err := conn.Exec("delete from orders where order_uid <> '';delete from items where chrt_id <> 0;" +
-		"delete from payments where payment_id <> '';delete from deliveries where delivery_id <> ''")
+	err := conn.Exec("DELETE FROM order_items; DELETE FROM payments; DELETE FROM deliveries; DELETE FROM orders; " +
+		"DELETE FROM order_versions")
 	if err.Error != nil {
-		panic(fmt.Sprintf("can't clear tables: %v", err))
+		panic(fmt.Sprintf("can't clear tables: %v", err.Error))
 	}
 }
@@ -0,0 +1,13 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Хэш содержимого сущности. Используется для того, чтобы отличить повторно присланный заказ от заказа с тем же
+// order_uid, но другим содержимым
+func HashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
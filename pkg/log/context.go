@@ -0,0 +1,45 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.uber.org/zap"
+)
+
+// HTTP-заголовок, в котором приходит и возвращается correlation ID запроса
+const CorrelationHeader = "X-Correlation-ID"
+
+type correlationKey struct{}
+
+// Новый случайный correlation ID
+func NewCorrelationID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// Контекст с correlation ID. Пустой id не сохраняется
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// Correlation ID из контекста, пустая строка - если его нет
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Логгер с полем correlation_id из контекста. Так все записи, сделанные по ходу одного HTTP-запроса
+// или обработки одного сообщения из кафки, можно найти по одному значению
+func FromContext(ctx context.Context, logger *zap.SugaredLogger) *zap.SugaredLogger {
+	if id := CorrelationID(ctx); id != "" {
+		return logger.With("correlation_id", id)
+	}
+	return logger
+}
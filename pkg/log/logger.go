@@ -1,23 +1,80 @@
 package log
 
 import (
-	"fmt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"time"
 )
 
-// Инициализация логгера в зависимости от того, какой файл с логами нужен
-func NewLogger(path string) *zap.SugaredLogger {
-	config := zap.NewDevelopmentConfig()
-	config.OutputPaths = []string{path, "stdout"}
-
-	logger, err := config.Build()
+// Настройки логгера. Level - минимальный уровень (debug, info, warn, error), Encoding - json или console,
+// OutputPaths - куда пишутся логи: пути к файлам, stdout или stderr.
+// Остальные поля - ротация файлов: MaxSizeMB - размер, после которого файл ротируется (0 - выключена),
+// RotateInterval - ротация по времени (0 - выключена), MaxBackups и MaxAgeDays - сколько старых файлов и сколько
+// дней их хранить (0 - без ограничения), Compress - сжимать ли старые файлы в gzip
+type Options struct {
+	Level          string
+	Encoding       string
+	OutputPaths    []string
+	MaxSizeMB      int
+	MaxAgeDays     int
+	MaxBackups     int
+	Compress       bool
+	RotateInterval time.Duration
+}
 
+// Инициализация логгера. По умолчанию логи пишутся в JSON: одна запись - один объект с полями ts, level, msg
+// и структурными полями вызова (order_uid, topic, partition, offset, stage, correlation_id и т.д.).
+// Файлы из OutputPaths ротируются (см. rotator). Вторым значением возвращается функция, которая сбрасывает
+// буферы логгера, останавливает ротацию и закрывает файлы - её нужно вызвать при завершении работы
+func NewLogger(opts Options) (*zap.SugaredLogger, func() error) {
+	level, err := zap.ParseAtomicLevel(opts.Level)
 	if err != nil {
-		panic(fmt.Sprintf("failed to configure logger: %v", err))
+		level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	}
+	encoding := opts.Encoding
+	if encoding != "console" {
+		encoding = "json"
+	}
+	outputPaths := opts.OutputPaths
+	if len(outputPaths) == 0 {
+		outputPaths = []string{"stdout"}
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "ts"
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	if encoding == "console" {
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	} else {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+
+	files := &rotator{}
+	outputs := make([]zapcore.WriteSyncer, 0, len(outputPaths))
+	for _, path := range outputPaths {
+		switch path {
+		case "stdout":
+			outputs = append(outputs, zapcore.Lock(os.Stdout))
+		case "stderr":
+			outputs = append(outputs, zapcore.Lock(os.Stderr))
+		default:
+			outputs = append(outputs, files.open(path, opts))
+		}
 	}
+	files.start(opts.RotateInterval)
+
+	core := zapcore.NewCore(encoder, zapcore.NewMultiWriteSyncer(outputs...), level)
+	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel),
+		zap.ErrorOutput(zapcore.Lock(os.Stderr)))
 
-	defer logger.Sync()
 	sugaredLogger := logger.Sugar()
-	sugaredLogger.Info("started logger")
-	return sugaredLogger
+	sugaredLogger.Infow("started logger", "level", level.String(), "encoding", encoding)
+	return sugaredLogger, func() error {
+		// Ошибку Sync не проверяем: для stdout в терминале она возвращается всегда
+		logger.Sync()
+		return files.close()
+	}
 }
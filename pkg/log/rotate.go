@@ -0,0 +1,113 @@
+package log
+
+import (
+	"errors"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"math"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ротация файлов с логами. Файл ротируется, когда превышает MaxSizeMB (если задан), и раз в RotateInterval
+// (если задан). Старые файлы сжимаются и удаляются по MaxBackups и MaxAgeDays.
+// По сигналу SIGHUP файлы только закрываются и открываются заново по исходному пути при следующей записи - так
+// сервис совместим с внешним logrotate: тот переименовывает файл и шлёт SIGHUP. В этом режиме собственную ротацию
+// нужно выключить (MaxSizeMB = 0 и RotateInterval = 0), иначе она будет создавать файлы в обход хранения logrotate
+type rotator struct {
+	files    []*lumberjack.Logger
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Размер файла, при котором lumberjack ротирует его, когда ротация по размеру выключена: у lumberjack
+// MaxSize = 0 означает 100 МБ, поэтому ставим заведомо недостижимый размер (в мегабайтах)
+const unlimitedSizeMB = math.MaxInt32
+
+// Писатель в файл с ротацией по настройкам логгера
+func (r *rotator) open(path string, opts Options) zapcore.WriteSyncer {
+	maxSize := opts.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = unlimitedSizeMB
+	}
+	file := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxAge:     opts.MaxAgeDays,
+		MaxBackups: opts.MaxBackups,
+		Compress:   opts.Compress,
+		LocalTime:  true,
+	}
+	r.files = append(r.files, file)
+	return zapcore.AddSync(file)
+}
+
+// Запуск фоновой горутины, которая переоткрывает файлы по SIGHUP и ротирует их по тикеру. Если файлов нет, то ничего не делаем
+func (r *rotator) start(interval time.Duration) {
+	if len(r.files) == 0 {
+		return
+	}
+	r.quit = make(chan struct{})
+	r.done = make(chan struct{})
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		defer close(r.done)
+		defer signal.Stop(hangup)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-hangup:
+				r.reopen()
+			case <-tick:
+				r.rotate()
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Ротация всех файлов. Ошибку писать в лог некуда (логгер пишет в эти же файлы), поэтому выводим её в stderr
+func (r *rotator) rotate() {
+	for _, file := range r.files {
+		if err := file.Rotate(); err != nil {
+			os.Stderr.WriteString("failed on rotating log file " + file.Filename + ": " + err.Error() + "\n")
+		}
+	}
+}
+
+// Закрытие всех файлов: lumberjack откроет файл по исходному пути при следующей записи. Если logrotate
+// уже переименовал файл, то будет создан новый
+func (r *rotator) reopen() {
+	for _, file := range r.files {
+		if err := file.Close(); err != nil {
+			os.Stderr.WriteString("failed on reopening log file " + file.Filename + ": " + err.Error() + "\n")
+		}
+	}
+}
+
+// Остановка фоновой ротации и закрытие файлов
+func (r *rotator) close() error {
+	var errs []error
+	r.stopOnce.Do(func() {
+		if r.quit != nil {
+			close(r.quit)
+			<-r.done
+		}
+		for _, file := range r.files {
+			errs = append(errs, file.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Политика повторов: экспоненциально растущая задержка между попытками со случайным разбросом (jitter),
+// чтобы несколько экземпляров сервиса не повторяли запросы синхронно
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+// Вызов operation до первого успеха, до первой ошибки, которую isTransient не считает временной, или до исчерпания
+// попыток. Возвращает количество сделанных попыток и последнюю ошибку. Ожидание между попытками прерывается
+// отменой контекста
+func (p Policy) Do(ctx context.Context, operation func() error, isTransient func(error) bool) (int, error) {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = operation(); err == nil {
+			return attempt, nil
+		}
+		if attempt >= maxAttempts || !isTransient(err) {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		}
+	}
+}
+
+// Задержка после попытки с номером attempt (нумерация с единицы)
+func (p Policy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
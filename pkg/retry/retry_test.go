@@ -0,0 +1,105 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTransient = errors.New("transient")
+
+func isTransient(err error) bool {
+	return errors.Is(err, errTransient)
+}
+
+func TestDoRetriesTransientErrorsUntilSuccess(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, InitialBackoff: time.Millisecond, Multiplier: 2}
+	calls := 0
+	attempts, err := policy.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	}, isTransient)
+	if err != nil || attempts != 3 || calls != 3 {
+		t.Fatalf("expected success on attempt 3, got %v attempts, %v calls, error %v", attempts, calls, err)
+	}
+}
+
+func TestDoStopsAfterMaxAttempts(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	calls := 0
+	attempts, err := policy.Do(context.Background(), func() error {
+		calls++
+		return errTransient
+	}, isTransient)
+	if !errors.Is(err, errTransient) || attempts != 3 || calls != 3 {
+		t.Fatalf("expected 3 failed attempts, got %v attempts, %v calls, error %v", attempts, calls, err)
+	}
+
+	// Без MaxAttempts делается одна попытка
+	attempts, _ = Policy{}.Do(context.Background(), func() error { return errTransient }, isTransient)
+	if attempts != 1 {
+		t.Fatalf("expected single attempt with zero MaxAttempts, got %v", attempts)
+	}
+}
+
+func TestDoDoesNotRetryPermanentErrors(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+	permanent := errors.New("permanent")
+	attempts, err := policy.Do(context.Background(), func() error { return permanent }, isTransient)
+	if !errors.Is(err, permanent) || attempts != 1 {
+		t.Fatalf("expected single attempt on permanent error, got %v attempts, error %v", attempts, err)
+	}
+}
+
+func TestDoStopsWaitingOnContextCancel(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, InitialBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	start := time.Now()
+	attempts, err := policy.Do(ctx, func() error { return errTransient }, isTransient)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("backoff is not interrupted by context, waited %v", elapsed)
+	}
+	// Возвращается ошибка последней попытки, а не ошибка контекста
+	if !errors.Is(err, errTransient) || attempts != 1 {
+		t.Fatalf("expected 1 attempt with last error, got %v attempts, error %v", attempts, err)
+	}
+}
+
+func TestBackoffGrowsExponentiallyUpToMax(t *testing.T) {
+	policy := Policy{InitialBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 50, Multiplier: 2}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for idx, backoff := range expected {
+		if actual := policy.Backoff(idx + 1); actual != backoff*time.Millisecond {
+			t.Fatalf("attempt %v: expected backoff %v, got %v", idx+1, backoff*time.Millisecond, actual)
+		}
+	}
+
+	// Множитель меньше единицы не уменьшает задержку
+	policy.Multiplier = 0.5
+	if actual := policy.Backoff(3); actual != time.Millisecond*10 {
+		t.Fatalf("expected constant backoff with multiplier below 1, got %v", actual)
+	}
+}
+
+func TestBackoffJitterStaysWithinBounds(t *testing.T) {
+	policy := Policy{InitialBackoff: time.Millisecond * 100, MaxBackoff: time.Millisecond * 100, Multiplier: 2,
+		Jitter: 0.2}
+	low, high := time.Millisecond*80, time.Millisecond*120
+	isSpread := false
+	for idx := 0; idx < 1000; idx++ {
+		backoff := policy.Backoff(3)
+		if backoff < low || backoff > high {
+			t.Fatalf("backoff %v is out of jitter bounds [%v, %v]", backoff, low, high)
+		}
+		isSpread = isSpread || backoff != time.Millisecond*100
+	}
+	if !isSpread {
+		t.Fatalf("expected jitter to spread backoff")
+	}
+}